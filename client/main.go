@@ -2,16 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	crypt "safechat/encryption"
+	"safechat/protocol"
 )
 
 const (
@@ -31,25 +37,89 @@ const (
 	SERVER_MSG   byte = 6
 	CLIENT_CLOSE byte = 7
 	SERVER_CLOSE byte = 8
+	SERVER_ACK   byte = 9
+	CLIENT_CAPS  byte = 10
+	SERVER_CAPS  byte = 11
+	CLIENT_LIST  byte = 12
+	SERVER_LIST  byte = 13
 )
 
+const USERNAME_DELIM = ":"
+
 type ConnState struct {
 	pubKey *crypt.PublicKey
 	symKey *[32]byte
+	suite  crypt.Suite
+	// acks is set when the server is asked to acknowledge messages rather
+	// than echo them.
+	acks bool
+	// msgSeq counts the non-empty CLIENT_MSG sent so far, the first one
+	// being 1.
+	msgSeq uint64
+	// metadata is attached to the hello.
+	metadata []byte
+	// correlationID is attached to the hello, the server must echo it.
+	correlationID []byte
+	// serverName is what the server advertised in its hello, if anything.
+	serverName string
+	// closing is set once CLIENT_CLOSE was sent, closed once the session is
+	// over.
+	closing bool
+	closed  bool
+	// insecure offers the NULL suite, after every real one.
+	insecure bool
+	// pinnedKey is the fingerprint the server's public key must have, if
+	// not empty.
+	pinnedKey string
+	// keepAlive is the keepalive period proposed in the hello, then the one
+	// the server agreed to, zero if it agreed to none.
+	keepAlive time.Duration
+}
+
+// ConnectionInfo is what ConnState.ConnectionState reports about the
+// server.
+type ConnectionInfo struct {
+	// ServerName is what the server advertised in its hello, empty when it
+	// advertised nothing.
+	ServerName string
+	// Suite is the cipher suite the server picked.
+	Suite crypt.Suite
+	// ServerFingerprint is that of the public key the server presented,
+	// empty before its hello.
+	ServerFingerprint string
+}
+
+// ConnectionState returns what the handshake learnt about the server so
+// far.
+func (s *ConnState) ConnectionState() ConnectionInfo {
+	info := ConnectionInfo{
+		ServerName: s.serverName,
+		Suite:      s.suite,
+	}
+	if s.pubKey != nil {
+		info.ServerFingerprint = s.pubKey.Fingerprint()
+	}
+	return info
 }
 
-func newState() ConnState {
+func newState(acks bool, pinnedKey string) ConnState {
 	return ConnState{
-		pubKey: nil,
-		symKey: nil,
+		pubKey:    nil,
+		symKey:    nil,
+		suite:     crypt.SUITE_AES_256_CFB,
+		acks:      acks,
+		msgSeq:    0,
+		pinnedKey: strings.ToLower(pinnedKey),
 	}
 }
 
-func readMessage() (byte, string) {
+// readMessage reads the next message from scanner, which must be the one
+// every other line of stdin is read through: a scanner buffers ahead, and a
+// second one would miss what the first took in.
+func readMessage(scanner *bufio.Scanner) (byte, string) {
 	var msg string
 
 	fmt.Print("Write your message: ")
-	scanner := bufio.NewScanner(os.Stdin)
 	if scanner.Scan() {
 		msg = scanner.Text()
 	}
@@ -67,15 +137,51 @@ func readMessage() (byte, string) {
 }
 
 func writeMsg(typ byte, msg string, s *ConnState) []byte {
-	sends := []byte{typ}
+	if typ == CLIENT_CLOSE && s.symKey != nil {
+		// Only our notify tells the server the close is ours, a bare one
+		// could come from anyone on the path.
+		msg = string(protocol.CloseNotify(CLIENT_CLOSE))
+	}
 	if s.symKey != nil && msg != "" {
-		msg = fmt.Sprintf("%s", crypt.EncryptAES(s.symKey[:], []byte(msg)))
+		ciphertext, err := s.suite.Encrypt(s.symKey[:], []byte(msg))
+		if err != nil {
+			panic(err)
+		}
+		msg = string(ciphertext)
+	}
+	sends, err := protocol.NewMessage(typ, []byte(msg)).MarshalBinary()
+	if err != nil {
+		panic(err)
 	}
-	sends = append(sends, []byte(msg)...)
 	return sends
 }
 
 func main() {
+	acks := flag.Bool("acks", false, "ask the server to acknowledge messages instead of echoing them")
+	probe := flag.Bool("probe", false, "print what the server supports and exit without a handshake")
+	debug := flag.Bool("debug", false, "dump every message read and written in hexadecimal")
+	metadata := flag.String("metadata", "", "opaque data sent to the server in the hello, such as a client version")
+	pin := flag.String("pin", "", "abort unless the server's public key has this SHA-256 fingerprint")
+	nagle := flag.Bool("nagle", false, "leave Nagle's algorithm on, trading latency for fewer packets")
+	correlation := flag.String("correlation", "", "token the server echoes and tags its logs for this connection with")
+	credential := flag.String("credential", "", "secret, such as a password, sent encrypted along with the username for the server to check")
+	insecure := flag.Bool("insecure", false, "also offer the NULL suite, which sends everything in the clear, for debugging only")
+	closeTimeout := flag.Duration("close-timeout", 5*time.Second, "how long to wait for the server to confirm a close before closing anyway, zero waiting forever")
+	keepAlive := flag.Duration("keepalive", 0, "TCP keepalive period to ask the server for, in whole seconds, zero leaving it to the server")
+	flag.Parse()
+	if len(*metadata) > protocol.MAX_METADATA_SIZE {
+		fmt.Printf("metadata is limited to %d bytes\n", protocol.MAX_METADATA_SIZE)
+		os.Exit(1)
+	}
+	if len(*correlation) > protocol.MAX_CORRELATION_ID_SIZE {
+		fmt.Printf("correlation id is limited to %d bytes\n", protocol.MAX_CORRELATION_ID_SIZE)
+		os.Exit(1)
+	}
+	if *keepAlive != 0 && (*keepAlive < time.Second || *keepAlive > protocol.MAX_KEEPALIVE_PERIOD || *keepAlive%time.Second != 0) {
+		fmt.Printf("keepalive period must be a whole number of seconds up to %v\n", protocol.MAX_KEEPALIVE_PERIOD)
+		os.Exit(1)
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 	address := ""
 	fmt.Print("please enter address (defaults to localhost:6699): ")
@@ -92,14 +198,54 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if tcp, ok := connection.(*net.TCPConn); ok {
+		if err := tcp.SetNoDelay(!*nagle); err != nil {
+			fmt.Printf("could not set TCP_NODELAY: %v\n", err)
+		}
+	}
+	if *debug {
+		connection = protocol.NewDumpConn(connection)
+	}
 
-	state := newState()
+	if *probe {
+		probeServer(connection)
+		return
+	}
+
+	username := ""
+	fmt.Print("please enter username (leave empty to stay anonymous): ")
+	if scanner.Scan() {
+		username = scanner.Text()
+	}
+
+	if *credential != "" && username == "" {
+		fmt.Println("a credential can only be sent along with a username")
+		os.Exit(1)
+	}
 
-	autoConnect(connection, &state)
+	state := newState(*acks, *pin)
+	state.metadata = []byte(*metadata)
+	state.correlationID = []byte(*correlation)
+	state.insecure = *insecure
+	state.keepAlive = *keepAlive
+
+	if err := autoConnect(connection, &state, username, *credential); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	//processMessage(connection, &state)
 
 	for {
-		typ, msg := readMessage()
+		typ, msg := readMessage(scanner)
+		if typ == CLIENT_MSG && msg != "" {
+			state.msgSeq++
+		}
+		if typ == CLIENT_CLOSE {
+			state.closing = true
+			if *closeTimeout > 0 {
+				connection.SetReadDeadline(time.Now().Add(*closeTimeout))
+			}
+		}
 		sends := writeMsg(typ, msg, &state)
 		_, err := connection.Write(sends)
 		if err != nil {
@@ -107,93 +253,292 @@ func main() {
 		}
 		// send the hello automatically so it's taken care of by the client
 		displayMessage(connection, &state)
+		if state.closed {
+			connection.Close()
+			return
+		}
 	}
 }
 
-func autoConnect(connection net.Conn, s *ConnState) {
-	sends := []byte{CLIENT_HELLO}
-	connection.Write(sends)
+// autoConnect runs the handshake on connection, and returns why it failed,
+// if it did.
+func autoConnect(connection net.Conn, s *ConnState, username, credential string) error {
+	// Every handshake record goes through the transcript, which the server
+	// proves it saw the same of in SERVER_DONE.
+	transcript := protocol.NewTranscript()
+
+	// The server must sign this to show it holds the key it presents.
+	challenge := make([]byte, protocol.CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	hello := protocol.ClientHello{RequestAcks: s.acks, Metadata: s.metadata, CorrelationID: s.correlationID, Challenge: challenge, KeepAlive: s.keepAlive}
+	for _, suite := range crypt.SupportedSuites() {
+		hello.Suites = append(hello.Suites, byte(suite))
+	}
+	if s.insecure {
+		hello.Suites = append(hello.Suites, byte(crypt.SUITE_NULL))
+	}
+	helloBytes, err := hello.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := transcript.WriteRecord(connection, CLIENT_HELLO, helloBytes); err != nil {
+		return err
+	}
 
 	// Receives server hello
-	buffer, mLen, err := readFromServer(connection)
+	reply, err := readFromServer(connection)
 	if err != nil {
-		fmt.Printf("an error occured: %v", err)
+		return err
 	}
-	header := buffer[0]
-	content := buffer[1:mLen]
+	header := reply.Header
 
-	if header != SERVER_HELLO {
-		fmt.Println("an error occured during the handshake")
-		os.Exit(1)
+	if header == ERROR {
+		return handshakeError(reply)
+	}
+	var serverHello protocol.ServerHello
+	if header != SERVER_HELLO || serverHello.UnmarshalBinary(reply.Body) != nil {
+		return errors.New("an error occured during the handshake")
 	}
+	transcript.Add(reply)
 
 	// Generate symmetric key after client hello
 	fmt.Println("[server hello] received server hello")
 
+	s.suite = crypt.Suite(serverHello.Suite)
+	if !s.suite.Supported() && !(s.insecure && s.suite == crypt.SUITE_NULL) {
+		return fmt.Errorf("server picked unsupported cipher suite %d", serverHello.Suite)
+	}
+	fmt.Printf("[server hello] cipher suite is %s\n", s.suite)
+	if s.suite == crypt.SUITE_NULL {
+		fmt.Println("WARNING: this session is not encrypted, anyone on the path can read and alter it")
+	}
+	if serverHello.ServerName != "" {
+		s.serverName = serverHello.ServerName
+		fmt.Printf("[server hello] server is %q\n", s.serverName)
+	}
+
+	if s.keepAlive != 0 {
+		s.keepAlive = serverHello.KeepAlive
+	}
+	if s.keepAlive != 0 {
+		// Probe the server as often as it probes us, so that either end
+		// notices a dead path as soon as the other.
+		if tcp, ok := connection.(*net.TCPConn); ok {
+			if err := tcp.SetKeepAlive(true); err == nil {
+				tcp.SetKeepAlivePeriod(s.keepAlive)
+			}
+		}
+		fmt.Printf("[server hello] keepalive period is %v\n", s.keepAlive)
+	}
+
+	if !bytes.Equal(serverHello.CorrelationID, s.correlationID) {
+		return fmt.Errorf("server echoed correlation id %q instead of %q", serverHello.CorrelationID, s.correlationID)
+	}
+
 	pubKey := &crypt.PublicKey{}
-	pubKey.Unmarshal(content)
+	if err := pubKey.Unmarshal(serverHello.PublicKey); err != nil {
+		return fmt.Errorf("server sent an invalid public key: %w", err)
+	}
+	if err := protocol.VerifyChallenge(pubKey, challenge, serverHello.ChallengeSignature); err != nil {
+		return errors.New("server could not prove it holds the private key of its public key")
+	}
+	fingerprint := pubKey.Fingerprint()
+	if s.pinnedKey != "" && fingerprint != s.pinnedKey {
+		return fmt.Errorf("server public key %s does not match the pinned key %s", fingerprint, s.pinnedKey)
+	}
 	s.pubKey = pubKey
 
-	fmt.Printf("[server hello] public key is %+v\n", pubKey)
+	fmt.Printf("[server hello] public key is %+v (fingerprint %s)\n", pubKey, fingerprint)
 
 	symKey := generateSymKey()
 	fmt.Printf("[server hello] generated sym key: %v\n", symKey)
 
+	// The username and credential go encrypted under the key they travel
+	// with, so that they are not readable on the wire. The NULL suite would
+	// send them in the clear, a credential is never worth that.
+	if credential != "" && s.suite == crypt.SUITE_NULL {
+		return errors.New("refusing to send a credential over the NULL suite, it would travel in the clear")
+	}
 	msg := pubKey.EncryptString(symKey[:])
-	connection.Write(writeMsg(CLIENT_DONE, msg, s))
+	if username != "" {
+		identity := username
+		if credential != "" {
+			identity += USERNAME_DELIM + credential
+		}
+		usernameEncrypted, err := s.suite.Encrypt(symKey[:], []byte(identity))
+		if err != nil {
+			return err
+		}
+		msg += USERNAME_DELIM + string(usernameEncrypted)
+	}
+	if err := transcript.WriteRecord(connection, CLIENT_DONE, []byte(msg)); err != nil {
+		return err
+	}
 
 	s.symKey = &symKey
 
 	// Receives server done
-	buffer, mLen, err = readFromServer(connection)
+	reply, err = readFromServer(connection)
 	if err != nil {
-		fmt.Printf("an error occured: %v", err)
+		return err
+	}
+	header = reply.Header
+	if header == ERROR {
+		return handshakeError(reply)
 	}
-	header = buffer[0]
 	if header != SERVER_DONE {
-		fmt.Println("did not receive server done")
-		os.Exit(1)
+		return errors.New("did not receive server done")
+	}
+	finished, err := s.suite.Decrypt(symKey[:], reply.Body)
+	if err != nil || !bytes.HasPrefix(finished, []byte(protocol.SERVER_FINISHED)) {
+		return errors.New("server done could not be verified, the server does not hold our key")
+	}
+	if !bytes.Equal(finished[len(protocol.SERVER_FINISHED):], transcript.Sum()) {
+		return errors.New("server done could not be verified, the handshake was tampered with")
 	}
 	fmt.Println("[server done] handshake complete")
+	return nil
 }
 
-func readFromServer(connection net.Conn) ([]byte, int, error) {
-	buffer := make([]byte, 1024*1024)
-	mLen, err := connection.Read(buffer)
+// handshakeError describes the ERROR the server answered the handshake with.
+func handshakeError(reply protocol.Message) error {
+	code, text, correlationID, err := protocol.ParseErrorBody(reply.Body)
 	if err != nil {
-		return nil, 0, err
+		return errors.New("handshake failed: received malformed error")
+	}
+	return fmt.Errorf("handshake failed: received error %d: %s%s", code, text, correlationSuffix(correlationID))
+}
+
+// probeServer asks the server for its capabilities and prints them.
+func probeServer(connection net.Conn) {
+	s := newState(false, "")
+	connection.Write(writeMsg(CLIENT_CAPS, "", &s))
+
+	reply, err := readFromServer(connection)
+	if err != nil {
+		fmt.Printf("an error occured: %v\n", err)
+		os.Exit(1)
 	}
-	if mLen == 0 {
-		return nil, 0, errors.New("Received null message")
+	var caps protocol.Caps
+	if reply.Header != SERVER_CAPS || caps.UnmarshalBinary(reply.Body) != nil {
+		fmt.Println("server did not answer with its capabilities")
+		os.Exit(1)
+	}
+	fmt.Printf("[server caps] protocol versions %d to %d\n", caps.MinVersion, caps.MaxVersion)
+	for _, suite := range caps.Suites {
+		fmt.Printf("[server caps] cipher suite %s\n", crypt.Suite(suite))
 	}
-	return buffer, mLen, nil
+}
+
+// correlationSuffix formats the correlation id an ERROR echoed, if any, for
+// appending to its description.
+func correlationSuffix(correlationID []byte) string {
+	if len(correlationID) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (correlation %q)", correlationID)
+}
+
+func readFromServer(connection net.Conn) (protocol.Message, error) {
+	return protocol.ReadRecord(connection)
 }
 
 func displayMessage(connection net.Conn, s *ConnState) (byte, error) {
 
-	buffer, mLen, err := readFromServer(connection)
+	msg, err := readFromServer(connection)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// Only the server's SERVER_CLOSE ends a session, whoever cut the
+		// stream short, between records or in the middle of one, may have
+		// done so to drop what came next.
+		fmt.Println("[error] session truncated: the connection ended without a server close")
+		os.Exit(1)
+	}
+	var netErr net.Error
+	if s.closing && errors.As(err, &netErr) && netErr.Timeout() {
+		fmt.Println("[error] close timed out: the server did not confirm the close, closing anyway")
+		connection.Close()
+		os.Exit(1)
+	}
 	if err != nil {
-		fmt.Printf("an error occured: %v", err)
+		fmt.Printf("an error occured: %v\n", err)
+		os.Exit(1)
 	}
-	header := buffer[0]
-	content := buffer[1:mLen]
+	header := msg.Header
+	content := msg.Body
 
 	switch header {
 	case SERVER_HELLO:
 
 		fmt.Println("[server hello] received server hello")
+		var serverHello protocol.ServerHello
+		if err := serverHello.UnmarshalBinary(content); err != nil {
+			fmt.Printf("[server hello] malformed server hello: %v\n", err)
+			break
+		}
+		fmt.Printf("[server hello] cipher suite is %s\n", crypt.Suite(serverHello.Suite))
 		pubKey := &crypt.PublicKey{}
-		pubKey.Unmarshal(content)
+		if err := pubKey.Unmarshal(serverHello.PublicKey); err != nil {
+			fmt.Printf("[server hello] server sent an invalid public key: %v\n", err)
+			break
+		}
 		fmt.Printf("[server hello] public key is %+v\n", pubKey)
 
 	case SERVER_MSG:
 		fmt.Printf("[message] server encrypted message as: %s\n", base64.URLEncoding.EncodeToString(content))
 
+	case SERVER_ACK:
+		if len(content) != 8 {
+			fmt.Println("[error] received malformed ack")
+			break
+		}
+		seq := binary.BigEndian.Uint64(content)
+		if seq != s.msgSeq {
+			fmt.Printf("[error] server acknowledged message #%d, expected #%d\n", seq, s.msgSeq)
+			break
+		}
+		fmt.Printf("[ack] server accepted message #%d\n", seq)
+
 	case SERVER_DONE:
 		fmt.Println("[server done] handshake complete")
 
+	case SERVER_LIST:
+		if s.symKey == nil {
+			fmt.Println("[error] received a participant list outside of a session")
+			break
+		}
+		list, err := s.suite.Decrypt(s.symKey[:], content)
+		if err != nil {
+			fmt.Println("[error] received a participant list that does not decrypt")
+			break
+		}
+		fmt.Printf("[list] connected: %s\n", strings.ReplaceAll(string(list), protocol.PARTICIPANT_DELIM, ", "))
+
+	case SERVER_CLOSE:
+		if s.symKey != nil {
+			notify, err := s.suite.Decrypt(s.symKey[:], content)
+			if err != nil || !bytes.Equal(notify, protocol.CloseNotify(SERVER_CLOSE)) {
+				fmt.Println("[error] session truncated: received a server close the server did not send")
+				os.Exit(1)
+			}
+		}
+		// Unless this answers our own CLIENT_CLOSE the server is closing on
+		// its own, acknowledge it. A close crossing ours needs no answer.
+		if !s.closing {
+			s.closing = true
+			connection.Write(writeMsg(CLIENT_CLOSE, "", s))
+		}
+		s.closed = true
+		fmt.Println("[server close] session closed")
+
 	case ERROR:
-		fmt.Printf("[error] received error: %s\n", content)
+		code, text, correlationID, err := protocol.ParseErrorBody(content)
+		if err != nil {
+			fmt.Println("[error] received malformed error")
+			break
+		}
+		fmt.Printf("[error] received error %d: %s%s\n", code, text, correlationSuffix(correlationID))
 
 	default:
 		fmt.Println("[error] handshake complete")
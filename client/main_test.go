@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// fakeServer answers one handshake the way the server does, presenting a
+// fixed key pair.
+type fakeServer struct {
+	pub  crypt.PublicKey
+	priv crypt.PrivateKey
+	name string
+	// helloKey, when not nil, goes out in SERVER_HELLO instead of pub.
+	helloKey []byte
+	// suite, when not zero, is picked instead of CBC+HMAC, offered or not.
+	suite crypt.Suite
+	// offered is the suites of the last CLIENT_HELLO.
+	offered []byte
+}
+
+func newFakeServer() *fakeServer {
+	pub, priv := crypt.GenerateKeyPair()
+	return &fakeServer{pub: pub, priv: priv}
+}
+
+// serve runs the server side of a handshake on conn.
+func (f *fakeServer) serve(conn net.Conn) error {
+	transcript := protocol.NewTranscript()
+	msg, err := protocol.ReadRecord(conn)
+	if err != nil {
+		return err
+	}
+	var hello protocol.ClientHello
+	if msg.Header != CLIENT_HELLO || hello.UnmarshalBinary(msg.Body) != nil {
+		return fmt.Errorf("got record %d, want a CLIENT_HELLO", msg.Header)
+	}
+	transcript.Add(msg)
+	f.offered = hello.Suites
+
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	if f.suite != 0 {
+		suite = f.suite
+	}
+	serverHello := protocol.ServerHello{
+		Suite:         byte(suite),
+		PublicKey:     f.pub.Marshal(),
+		CorrelationID: hello.CorrelationID,
+		ServerName:    f.name,
+	}
+	serverHello.ChallengeSignature = protocol.SignChallenge(&f.priv, hello.Challenge, serverHello.PublicKey)
+	if f.helloKey != nil {
+		serverHello.PublicKey = f.helloKey
+	}
+	body, err := serverHello.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := transcript.WriteRecord(conn, SERVER_HELLO, body); err != nil {
+		return err
+	}
+
+	msg, err = protocol.ReadRecord(conn)
+	if err != nil {
+		return err
+	}
+	if msg.Header != CLIENT_DONE {
+		return fmt.Errorf("got record %d, want a CLIENT_DONE", msg.Header)
+	}
+	transcript.Add(msg)
+	encryptedKey, _, _ := strings.Cut(string(msg.Body), USERNAME_DELIM)
+	key, err := f.priv.DecryptKey(encryptedKey, 32)
+	if err != nil {
+		return err
+	}
+	finished, err := suite.Encrypt(key, append([]byte(protocol.SERVER_FINISHED), transcript.Sum()...))
+	if err != nil {
+		return err
+	}
+	return protocol.WriteRecord(conn, SERVER_DONE, finished)
+}
+
+// handshakeWith runs autoConnect for s against f, and returns the errors of
+// both sides.
+func handshakeWith(t *testing.T, f *fakeServer, s *ConnState) (clientErr, serverErr error) {
+	t.Helper()
+	client, server := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		served <- f.serve(server)
+	}()
+	clientErr = autoConnect(client, s, "bob", "")
+	// A client giving up closes the connection.
+	client.Close()
+	return clientErr, <-served
+}
+
+func TestPinnedKey(t *testing.T) {
+	f := newFakeServer()
+	for _, pin := range []string{f.pub.Fingerprint(), strings.ToUpper(f.pub.Fingerprint())} {
+		s := newState(false, pin)
+		if clientErr, serverErr := handshakeWith(t, f, &s); clientErr != nil || serverErr != nil {
+			t.Errorf("pin %s: handshake failed: client %v, server %v", pin, clientErr, serverErr)
+		}
+	}
+}
+
+func TestPinnedKeyMismatch(t *testing.T) {
+	f := newFakeServer()
+	other, _ := crypt.GenerateKeyPair()
+	s := newState(false, other.Fingerprint())
+	clientErr, serverErr := handshakeWith(t, f, &s)
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "does not match the pinned key") {
+		t.Errorf("autoConnect() = %v, want a pin mismatch", clientErr)
+	}
+	// The client gave up before sending any key material.
+	if !errors.Is(serverErr, io.EOF) {
+		t.Errorf("server got %v after the hello, want EOF", serverErr)
+	}
+	if s.symKey != nil || s.pubKey != nil {
+		t.Error("client kept the key of a server failing its pin")
+	}
+}
+
+func TestServerCloseAnswered(t *testing.T) {
+	for _, closing := range []bool{false, true} {
+		key := generateSymKey()
+		s := newState(false, "")
+		s.suite = crypt.SUITE_AES_256_CBC_HMAC_SHA256
+		s.symKey = &key
+		s.closing = closing
+		notify, err := s.suite.Encrypt(key[:], protocol.CloseNotify(SERVER_CLOSE))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, server := net.Pipe()
+		answer := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			if err := protocol.WriteRecord(server, SERVER_CLOSE, notify); err != nil {
+				answer <- err
+				return
+			}
+			msg, err := protocol.ReadRecord(server)
+			if err != nil {
+				answer <- err
+				return
+			}
+			if msg.Header != CLIENT_CLOSE {
+				answer <- fmt.Errorf("got record %d, want CLIENT_CLOSE", msg.Header)
+				return
+			}
+			// The answer carries our own notify, bound to its direction.
+			if got, err := s.suite.Decrypt(key[:], msg.Body); err != nil || !bytes.Equal(got, protocol.CloseNotify(CLIENT_CLOSE)) {
+				answer <- fmt.Errorf("CLIENT_CLOSE carries %q, %v, want the close notify", got, err)
+				return
+			}
+			answer <- nil
+		}()
+		displayMessage(client, &s)
+		client.Close()
+		err = <-answer
+
+		if !s.closed {
+			t.Errorf("closing %v: session not closed after a SERVER_CLOSE", closing)
+		}
+		// A SERVER_CLOSE crossing our own CLIENT_CLOSE already has its
+		// answer, any other gets exactly one.
+		if closing && !errors.Is(err, io.EOF) {
+			t.Errorf("closing %v: server got %v, want EOF", closing, err)
+		}
+		if !closing && err != nil {
+			t.Errorf("closing %v: server got %v, want a CLIENT_CLOSE", closing, err)
+		}
+	}
+}
+
+func TestConnectionStateServerName(t *testing.T) {
+	f := newFakeServer()
+	f.name = "safechat/1.2"
+	s := newState(false, "")
+	if clientErr, serverErr := handshakeWith(t, f, &s); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	info := s.ConnectionState()
+	if info.ServerName != "safechat/1.2" {
+		t.Errorf("ServerName = %q, want %q", info.ServerName, "safechat/1.2")
+	}
+	if info.Suite != crypt.SUITE_AES_256_CBC_HMAC_SHA256 {
+		t.Errorf("Suite = %s, want %s", info.Suite, crypt.SUITE_AES_256_CBC_HMAC_SHA256)
+	}
+	if info.ServerFingerprint != f.pub.Fingerprint() {
+		t.Errorf("ServerFingerprint = %s, want %s", info.ServerFingerprint, f.pub.Fingerprint())
+	}
+
+	// A server advertising nothing leaves the name empty.
+	s = newState(false, "")
+	if clientErr, serverErr := handshakeWith(t, newFakeServer(), &s); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	if name := s.ConnectionState().ServerName; name != "" {
+		t.Errorf("ServerName = %q for a server advertising none", name)
+	}
+}
+
+func TestInvalidServerKey(t *testing.T) {
+	for _, key := range [][]byte{{}, []byte("garbage"), []byte("12,"), []byte("0,0")} {
+		f := newFakeServer()
+		f.helloKey = key
+		s := newState(false, "")
+		clientErr, serverErr := handshakeWith(t, f, &s)
+		if clientErr == nil || !strings.Contains(clientErr.Error(), "server sent an invalid public key") {
+			t.Errorf("key %q: autoConnect() = %v, want an invalid public key error", key, clientErr)
+		}
+		if !errors.Is(serverErr, io.EOF) {
+			t.Errorf("key %q: server got %v after the hello, want EOF", key, serverErr)
+		}
+		if s.pubKey != nil || s.symKey != nil {
+			t.Errorf("key %q: client kept an invalid server key", key)
+		}
+	}
+}
+
+func TestNullSuiteNeedsClientOptIn(t *testing.T) {
+	f := newFakeServer()
+	f.suite = crypt.SUITE_NULL
+	s := newState(false, "")
+	clientErr, serverErr := handshakeWith(t, f, &s)
+	if bytes.IndexByte(f.offered, byte(crypt.SUITE_NULL)) >= 0 {
+		t.Errorf("client offered the NULL suite in %v without -insecure", f.offered)
+	}
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "unsupported cipher suite") {
+		t.Errorf("autoConnect() = %v, want an unsupported cipher suite error", clientErr)
+	}
+	if !errors.Is(serverErr, io.EOF) {
+		t.Errorf("server got %v after the hello, want EOF", serverErr)
+	}
+
+	s = newState(false, "")
+	s.insecure = true
+	if clientErr, serverErr := handshakeWith(t, f, &s); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	if s.suite != crypt.SUITE_NULL {
+		t.Errorf("negotiated %s, want NULL", s.suite)
+	}
+}
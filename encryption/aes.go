@@ -4,39 +4,45 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"fmt"
 	"io"
 )
 
-func EncryptAES(key []byte, plaintext []byte) []byte {
-	block, err := aes.NewCipher(key)
+func EncryptAES(key []byte, plaintext []byte) ([]byte, error) {
+	return encryptAES(rand.Reader, key, plaintext)
+}
+
+// encryptAES is EncryptAES drawing the IV from random.
+func encryptAES(random io.Reader, key []byte, plaintext []byte) ([]byte, error) {
+	block, err := newCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// The IV needs to be unique, but not secure. Therefore it's common to
 	// include it at the beginning of the ciphertext.
 	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
 	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		panic(err)
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, err
 	}
 
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
 
-	return ciphertext
+	return ciphertext, nil
 }
 
-func DecryptAES(key []byte, ciphertext []byte) []byte {
-	block, err := aes.NewCipher(key)
+func DecryptAES(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := newCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// The IV needs to be unique, but not secure. Therefore it's common to
 	// include it at the beginning of the ciphertext.
 	if len(ciphertext) < aes.BlockSize {
-		panic("ciphertext too short")
+		return nil, fmt.Errorf("%w: too short", ErrBadCiphertext)
 	}
 	iv := ciphertext[:aes.BlockSize]
 	ciphertext = ciphertext[aes.BlockSize:]
@@ -45,5 +51,42 @@ func DecryptAES(key []byte, ciphertext []byte) []byte {
 
 	// XORKeyStream can work in-place if the two arguments are the same.
 	stream.XORKeyStream(ciphertext, ciphertext)
-	return ciphertext
+	return ciphertext, nil
+}
+
+// DecryptAESInto decrypts ciphertext and appends the plaintext to dst,
+// returning the extended slice. Passing dst[:0] lets callers reuse the same
+// buffer across messages. The ciphertext itself is left untouched.
+func DecryptAESInto(dst, key, ciphertext []byte) ([]byte, error) {
+	block, err := newCipher(key)
+	if err != nil {
+		return dst, err
+	}
+
+	if len(ciphertext) < aes.BlockSize {
+		return dst, fmt.Errorf("%w: too short", ErrBadCiphertext)
+	}
+	iv := ciphertext[:aes.BlockSize]
+	ciphertext = ciphertext[aes.BlockSize:]
+
+	n := len(dst)
+	if cap(dst)-n < len(ciphertext) {
+		grown := make([]byte, n, n+len(ciphertext))
+		copy(grown, dst)
+		dst = grown
+	}
+	dst = dst[:n+len(ciphertext)]
+
+	stream := cipher.NewCFBDecrypter(block, iv)
+	stream.XORKeyStream(dst[n:], ciphertext)
+	return dst, nil
+}
+
+// newCipher is aes.NewCipher reporting bad key sizes as ErrKeyLength.
+func newCipher(key []byte) (cipher.Block, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %d bytes", ErrKeyLength, len(key))
+	}
+	return block, nil
 }
@@ -0,0 +1,58 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecryptAESIntoReusesDst(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	messages := [][]byte{
+		[]byte("a first message, longer than the ones after it"),
+		[]byte("second"),
+		{},
+		[]byte("third message"),
+	}
+
+	dst := make([]byte, 0, 64)
+	for _, message := range messages {
+		ciphertext, err := EncryptAES(key, message)
+		if err != nil {
+			t.Fatalf("EncryptAES(%q) = %v", message, err)
+		}
+		saved := append([]byte{}, ciphertext...)
+
+		got, err := DecryptAESInto(dst[:0], key, ciphertext)
+		if err != nil {
+			t.Fatalf("DecryptAESInto(%q) = %v", message, err)
+		}
+		if !bytes.Equal(got, message) {
+			t.Errorf("DecryptAESInto() = %q, want %q", got, message)
+		}
+		if &got[:cap(got)][0] != &dst[:cap(dst)][0] {
+			t.Errorf("DecryptAESInto(%q) did not reuse dst", message)
+		}
+		if !bytes.Equal(ciphertext, saved) {
+			t.Errorf("DecryptAESInto(%q) modified the ciphertext", message)
+		}
+		dst = got
+	}
+}
+
+func TestDecryptAESIntoAppends(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	ciphertext, err := EncryptAES(key, []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Too small to hold the plaintext: DecryptAESInto has to grow it.
+	dst := make([]byte, 0, 6)
+	dst = append(dst, "hello "...)
+	got, err := DecryptAESInto(dst, key, ciphertext)
+	if err != nil {
+		t.Fatalf("DecryptAESInto() = %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("DecryptAESInto() = %q, want %q", got, "hello world")
+	}
+}
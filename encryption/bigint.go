@@ -196,6 +196,10 @@ func (a *BigInt) sub(b *BigInt) (result *BigInt) {
 }
 
 func (a *BigInt) mul(b *BigInt) (result *BigInt) {
+	if len(a.digits) == 0 || len(b.digits) == 0 {
+		return zero()
+	}
+
 	result = &BigInt{
 		digits: make([]int64, len(a.digits)+len(b.digits)-1),
 	}
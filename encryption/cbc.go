@@ -0,0 +1,104 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// EncryptAESCBCHMAC encrypts plaintext with AES-CBC and then authenticates
+// the IV and ciphertext with HMAC-SHA256 (encrypt-then-MAC). The encryption
+// and MAC keys are both derived from key, so a single shared secret is
+// enough. The output is IV || ciphertext || tag.
+func EncryptAESCBCHMAC(key []byte, plaintext []byte) ([]byte, error) {
+	return encryptAESCBCHMAC(rand.Reader, key, plaintext)
+}
+
+// encryptAESCBCHMAC is EncryptAESCBCHMAC drawing the IV from random.
+func encryptAESCBCHMAC(random io.Reader, key []byte, plaintext []byte) ([]byte, error) {
+	block, err := newCipher(deriveKey(key, "cbc encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	padded := pad(plaintext, aes.BlockSize)
+	ciphertext := make([]byte, aes.BlockSize+len(padded), aes.BlockSize+len(padded)+sha256.Size)
+	iv := ciphertext[:aes.BlockSize]
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, err
+	}
+
+	mode := cipher.NewCBCEncrypter(block, iv)
+	mode.CryptBlocks(ciphertext[aes.BlockSize:], padded)
+
+	mac := hmac.New(sha256.New, deriveKey(key, "cbc authentication"))
+	mac.Write(ciphertext)
+	return mac.Sum(ciphertext), nil
+}
+
+// DecryptAESCBCHMAC reverses EncryptAESCBCHMAC. The tag is checked before
+// anything is decrypted, so a tampered message is rejected without its
+// padding ever being looked at.
+func DecryptAESCBCHMAC(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 2*aes.BlockSize+sha256.Size {
+		return nil, fmt.Errorf("%w: too short", ErrBadCiphertext)
+	}
+	tag := ciphertext[len(ciphertext)-sha256.Size:]
+	ciphertext = ciphertext[:len(ciphertext)-sha256.Size]
+
+	mac := hmac.New(sha256.New, deriveKey(key, "cbc authentication"))
+	mac.Write(ciphertext)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, ErrDecryptAuth
+	}
+
+	block, err := newCipher(deriveKey(key, "cbc encryption"))
+	if err != nil {
+		return nil, err
+	}
+	iv := ciphertext[:aes.BlockSize]
+	ciphertext = ciphertext[aes.BlockSize:]
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: not a multiple of the block size", ErrBadCiphertext)
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	mode := cipher.NewCBCDecrypter(block, iv)
+	mode.CryptBlocks(plaintext, ciphertext)
+	return unpad(plaintext, aes.BlockSize)
+}
+
+// deriveKey derives a 32 bytes subkey of secret dedicated to label.
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// pad applies PKCS#7 padding.
+func pad(b []byte, blockSize int) []byte {
+	n := blockSize - len(b)%blockSize
+	return append(append([]byte{}, b...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+// unpad removes PKCS#7 padding.
+func unpad(b []byte, blockSize int) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: invalid padding", ErrBadCiphertext)
+	}
+	n := int(b[len(b)-1])
+	if n == 0 || n > blockSize || n > len(b) {
+		return nil, fmt.Errorf("%w: invalid padding", ErrBadCiphertext)
+	}
+	for _, c := range b[len(b)-n:] {
+		if int(c) != n {
+			return nil, fmt.Errorf("%w: invalid padding", ErrBadCiphertext)
+		}
+	}
+	return b[:len(b)-n], nil
+}
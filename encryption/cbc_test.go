@@ -0,0 +1,83 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestAESCBCHMACRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	for _, size := range []int{0, 1, aes.BlockSize - 1, aes.BlockSize, aes.BlockSize + 1, 100} {
+		plaintext := bytes.Repeat([]byte{'a'}, size)
+		ciphertext, err := EncryptAESCBCHMAC(key, plaintext)
+		if err != nil {
+			t.Fatalf("EncryptAESCBCHMAC(%d bytes) = %v", size, err)
+		}
+		got, err := DecryptAESCBCHMAC(key, ciphertext)
+		if err != nil {
+			t.Fatalf("DecryptAESCBCHMAC(%d bytes) = %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("DecryptAESCBCHMAC(%d bytes) = %q, want %q", size, got, plaintext)
+		}
+	}
+}
+
+func TestAESCBCHMACTamper(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	ciphertext, err := EncryptAESCBCHMAC(key, []byte("attack at dawn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flip := func(i int) []byte {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[i] ^= 1
+		return tampered
+	}
+	tests := []struct {
+		name       string
+		key        []byte
+		ciphertext []byte
+		want       error
+	}{
+		{"iv", key, flip(0), ErrDecryptAuth},
+		{"ciphertext", key, flip(aes.BlockSize), ErrDecryptAuth},
+		{"last block", key, flip(len(ciphertext) - sha256.Size - 1), ErrDecryptAuth},
+		{"tag", key, flip(len(ciphertext) - 1), ErrDecryptAuth},
+		{"another key", bytes.Repeat([]byte{0x43}, 32), ciphertext, ErrDecryptAuth},
+		{"block dropped", key, append(append([]byte{}, ciphertext[:aes.BlockSize]...), ciphertext[2*aes.BlockSize:]...), ErrBadCiphertext},
+		{"truncated", key, ciphertext[:2*aes.BlockSize+sha256.Size-1], ErrBadCiphertext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecryptAESCBCHMAC(tt.key, tt.ciphertext)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("DecryptAESCBCHMAC() = %q, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuiteRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := []byte("attack at dawn")
+	for _, suite := range append(SupportedSuites(), SUITE_NULL) {
+		t.Run(suite.String(), func(t *testing.T) {
+			ciphertext, err := suite.Encrypt(key, plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt() = %v", err)
+			}
+			got, err := suite.Decrypt(key, ciphertext)
+			if err != nil {
+				t.Fatalf("Decrypt() = %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("Decrypt() = %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package encryption
+
+import "errors"
+
+// Errors reported by the ciphers, possibly wrapped with more details. Callers
+// branch on them with errors.Is.
+var (
+	// ErrDecryptAuth means a ciphertext failed authentication: it was
+	// tampered with, or encrypted under another key.
+	ErrDecryptAuth = errors.New("message authentication failed")
+	// ErrKeyLength means a key has a size the cipher does not take.
+	ErrKeyLength = errors.New("invalid key length")
+	// ErrBadCiphertext means a ciphertext is malformed: too short, not a
+	// whole number of blocks, badly padded or badly encoded.
+	ErrBadCiphertext = errors.New("malformed ciphertext")
+)
@@ -0,0 +1,87 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// badPadding returns a CBC+HMAC ciphertext under key whose tag is valid but
+// whose plaintext does not end with PKCS#7 padding.
+func badPadding(t *testing.T, key []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(deriveKey(key, "cbc encryption"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, 2*aes.BlockSize)
+	cipher.NewCBCEncrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(ciphertext[aes.BlockSize:], bytes.Repeat([]byte{0x00}, aes.BlockSize))
+	mac := hmac.New(sha256.New, deriveKey(key, "cbc authentication"))
+	mac.Write(ciphertext)
+	return mac.Sum(ciphertext)
+}
+
+func TestCipherErrors(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	shortKey := key[:7]
+	cfb, err := EncryptAES(key, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbc, err := EncryptAESCBCHMAC(key, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, cbc...)
+	tampered[aes.BlockSize] ^= 1
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"EncryptAES short key", func() error { _, err := EncryptAES(shortKey, nil); return err }, ErrKeyLength},
+		{"DecryptAES short key", func() error { _, err := DecryptAES(shortKey, cfb); return err }, ErrKeyLength},
+		{"DecryptAES short ciphertext", func() error { _, err := DecryptAES(key, cfb[:aes.BlockSize-1]); return err }, ErrBadCiphertext},
+		{"DecryptAESInto short key", func() error { _, err := DecryptAESInto(nil, shortKey, cfb); return err }, ErrKeyLength},
+		{"DecryptAESInto short ciphertext", func() error { _, err := DecryptAESInto(nil, key, nil); return err }, ErrBadCiphertext},
+		{"DecryptAESCBCHMAC tampered", func() error { _, err := DecryptAESCBCHMAC(key, tampered); return err }, ErrDecryptAuth},
+		{"DecryptAESCBCHMAC short ciphertext", func() error { _, err := DecryptAESCBCHMAC(key, cbc[:len(cbc)-1]); return err }, ErrBadCiphertext},
+		{"DecryptAESCBCHMAC bad padding", func() error { _, err := DecryptAESCBCHMAC(key, badPadding(t, key)); return err }, ErrBadCiphertext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptStringErrors(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name       string
+		ciphertext string
+	}{
+		{"not base64", "!!!"},
+		{"not decimal", encode("12,a4")},
+		{"not a byte", encode(pub.encrypt(fromInt(300)).String())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := priv.DecryptString(tt.ciphertext); !errors.Is(err, ErrBadCiphertext) {
+				t.Errorf("DecryptString(%q) = %v, want ErrBadCiphertext", tt.ciphertext, err)
+			}
+			if _, err := priv.DecryptKey(tt.ciphertext, 2); err != ErrKeyTransport {
+				t.Errorf("DecryptKey(%q) = %v, want ErrKeyTransport", tt.ciphertext, err)
+			}
+		})
+	}
+}
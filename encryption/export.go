@@ -0,0 +1,42 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// MAX_EXPORT_LENGTH bounds what ExportKeyingMaterial derives in one call,
+// 255 blocks of P_SHA256 as HKDF does.
+const MAX_EXPORT_LENGTH = 255 * sha256.Size
+
+// ExportKeyingMaterial derives length bytes from the symmetric key of a
+// session, in the manner of RFC 5705. Both ends of a session get the same
+// output for the same label, and other implementations can check theirs
+// against it. The handshake has no randoms, so only the label is mixed in:
+//
+//	P_SHA256(secret, "EXPORTER " + label)
+//
+// with P_SHA256 as defined in RFC 5246, section 5. Servers export from an
+// established session through ConnState.ExportKeyingMaterial.
+func ExportKeyingMaterial(secret []byte, label string, length int) ([]byte, error) {
+	if length < 0 || length > MAX_EXPORT_LENGTH {
+		return nil, fmt.Errorf("cannot export %d bytes, the length must be between 0 and %d", length, MAX_EXPORT_LENGTH)
+	}
+	seed := []byte("EXPORTER " + label)
+	out := make([]byte, 0, length+sha256.Size)
+
+	// A(0) is the seed, A(i) the HMAC of A(i-1).
+	a := seed
+	for len(out) < length {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length], nil
+}
@@ -0,0 +1,43 @@
+package encryption
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The outputs were computed with Python's hmac module, following RFC 5246
+// P_SHA256, from vectorKey.
+func TestExportKeyingMaterialVector(t *testing.T) {
+	tests := []struct {
+		label  string
+		length int
+		want   string
+	}{
+		{"test label", 0, ""},
+		{"test label", 20, "b329a4ac7320c42eb577f5617d5c53413c9ddd29"},
+		// Longer than a block, and a prefix of it is the shorter output.
+		{"test label", 50, "b329a4ac7320c42eb577f5617d5c53413c9ddd29ddfaebb44cdade3abe64740e86da82c404d52b322800e8f95e8914394966"},
+		{"other label", 32, "16c69ab7bfd7b04e6a521cd1a5f3eac2339002afbc25e46d56d3bd8de191a311"},
+	}
+	for _, tt := range tests {
+		got, err := ExportKeyingMaterial(vectorKey, tt.label, tt.length)
+		if err != nil {
+			t.Fatalf("ExportKeyingMaterial(%q, %d) = %v", tt.label, tt.length, err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("ExportKeyingMaterial(%q, %d) = %x, want %s", tt.label, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestExportKeyingMaterialLength(t *testing.T) {
+	for _, length := range []int{-1, -33, MAX_EXPORT_LENGTH + 1} {
+		if out, err := ExportKeyingMaterial(vectorKey, "test label", length); err == nil {
+			t.Errorf("ExportKeyingMaterial(%d) = %x, want an error", length, out)
+		}
+	}
+	out, err := ExportKeyingMaterial(vectorKey, "test label", MAX_EXPORT_LENGTH)
+	if err != nil || len(out) != MAX_EXPORT_LENGTH {
+		t.Errorf("ExportKeyingMaterial(MAX_EXPORT_LENGTH) = %d bytes, %v", len(out), err)
+	}
+}
@@ -0,0 +1,37 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzPublicKeyUnmarshal(f *testing.F) {
+	pub, _ := GenerateKeyPair()
+	f.Add(pub.Marshal())
+	f.Add([]byte("3233,17"))
+	f.Add([]byte("3233,17,2753"))
+	f.Add([]byte("15,3"))
+	f.Add([]byte(","))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p PublicKey
+		if err := p.Unmarshal(data); err != nil {
+			if p.n != nil || p.e != nil {
+				t.Fatalf("Unmarshal(%q) failed with %v but set the key", data, err)
+			}
+			return
+		}
+		// An accepted key must be usable, and marshal to a key that is
+		// accepted too.
+		if p.EncryptString([]byte{0, 255}) == "" {
+			t.Fatalf("Unmarshal(%q) accepted a key that cannot encrypt", data)
+		}
+		var again PublicKey
+		if err := again.Unmarshal(p.Marshal()); err != nil {
+			t.Fatalf("Unmarshal(%q) = %v after accepting %q", p.Marshal(), err, data)
+		}
+		if !bytes.Equal(again.Marshal(), p.Marshal()) {
+			t.Fatalf("Marshal() = %q, then %q", p.Marshal(), again.Marshal())
+		}
+	})
+}
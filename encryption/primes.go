@@ -1,19 +1,26 @@
 package encryption
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
 )
 
-func generatePrimes(lower, upper uint64) (*BigInt, *BigInt) {
-	p := nextPrime(fromInt(int64(rand.Uint64()%(upper-lower) + lower)))
-	q := nextPrime(fromInt(int64(rand.Uint64()%(upper-lower) + lower)))
-	if p == q {
+func generatePrimes(random io.Reader, lower, upper uint64) (*BigInt, *BigInt, error) {
+	seeds := make([]byte, 16)
+	if _, err := io.ReadFull(random, seeds); err != nil {
+		return nil, nil, err
+	}
+	p := nextPrime(fromInt(int64(binary.BigEndian.Uint64(seeds[:8])%(upper-lower) + lower)))
+	q := nextPrime(fromInt(int64(binary.BigEndian.Uint64(seeds[8:])%(upper-lower) + lower)))
+	// Close seeds can land on the same prime. n = p² is trivially factored,
+	// and d computed from (p-1)(q-1) would not even decrypt.
+	if p.compare(q) == 0 {
 		q = nextPrime(q)
 	}
 	println(p.String())
 	println(q.String())
-	return p, q
+	return p, q, nil
 }
 
 func generateKeys(p, q *BigInt) (PrivateKey, PublicKey) {
@@ -29,12 +36,24 @@ func generateKeys(p, q *BigInt) (PrivateKey, PublicKey) {
 	d := modularInverse(e, p.prev().mul(q.prev()))
 	println(d.String())
 	println(e.String())
-	return PrivateKey{n, d}, PublicKey{n, e}
+	return PrivateKey{n, d, e}, PublicKey{n, e}
 }
 func GenerateKeyPair() (PublicKey, PrivateKey) {
-	rand.Seed(time.Now().Unix())
+	pub, priv, err := GenerateKeyPairFrom(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return pub, priv
+}
+
+// GenerateKeyPairFrom is GenerateKeyPair drawing its randomness from random,
+// so that the same source yields the same keys.
+func GenerateKeyPairFrom(random io.Reader) (PublicKey, PrivateKey, error) {
 	bound := uint64(1 << 16)
-	p, q := generatePrimes(bound, bound*2)
+	p, q, err := generatePrimes(random, bound, bound*2)
+	if err != nil {
+		return PublicKey{}, PrivateKey{}, err
+	}
 	priv, pub := generateKeys(p, q)
-	return pub, priv
+	return pub, priv, nil
 }
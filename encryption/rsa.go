@@ -1,13 +1,30 @@
 package encryption
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
+// ErrBadSignature is reported by Verify for any signature that does not
+// match.
+var ErrBadSignature = errors.New("signature verification failed")
+
+// ErrKeyTransport is the only error DecryptKey reports, whatever the reason
+// the payload was rejected.
+var ErrKeyTransport = errors.New("key transport failed")
+
 type PrivateKey struct {
 	n, d *BigInt
+	// e is the public exponent, kept so that the public half can be derived.
+	e *BigInt
 }
 
 type PublicKey struct {
@@ -34,46 +51,203 @@ func (p *PublicKey) String() string {
 	return fmt.Sprintf("<%s, %s>", p.n.String(), p.e.String())
 }
 
+// Fingerprint returns the hex encoded SHA-256 of the marshaled key.
+func (p *PublicKey) Fingerprint() string {
+	sum := sha256.Sum256(p.Marshal())
+	return hex.EncodeToString(sum[:])
+}
+
 func (p *PublicKey) Marshal() []byte {
 	return []byte(fmt.Sprintf("%s,%s", p.n.String(), p.e.String()))
 }
 
+// Unmarshal parses a key produced by Marshal. It checks that the key can
+// actually be used: EncryptString works byte by byte, so the modulus must be
+// larger than any byte value.
 func (p *PublicKey) Unmarshal(a []byte) error {
 	l := strings.Split(string(a), ",")
-	p.n = fromString(l[0])
-	p.e = fromString(l[1])
+	if len(l) != 2 || !isDecimal(l[0]) || !isDecimal(l[1]) {
+		return errors.New("public key must be two decimal numbers")
+	}
+	n, e := fromString(l[0]), fromString(l[1])
+	if n.compare(fromInt(255)) <= 0 {
+		return errors.New("public key modulus is too small")
+	}
+	if e.compare(fromInt(1)) <= 0 || e.compare(n) >= 0 {
+		return errors.New("public key exponent is out of range")
+	}
+	// n is a product of odd primes, and e must be coprime with the even
+	// phi(n). Anything else cannot be decrypted by whoever sent it.
+	if n.even() || e.even() {
+		return errors.New("public key is not a valid RSA key")
+	}
+	p.n, p.e = n, e
 	return nil
 }
 
+// MarshalJSON encodes the key as a JSON string holding the base64 of
+// Marshal. The zero key, which has nothing to marshal, is encoded as null.
+func (p PublicKey) MarshalJSON() ([]byte, error) {
+	if p.n == nil || p.e == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(p.Marshal()))
+}
+
+// UnmarshalJSON decodes a key encoded by MarshalJSON. null leaves p
+// unchanged, as it does for the standard types.
+func (p *PublicKey) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	a, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("public key is not valid base64: %w", err)
+	}
+	return p.Unmarshal(a)
+}
+
+// Public returns the public key matching p.
+func (p *PrivateKey) Public() PublicKey {
+	return PublicKey{p.n.copy(), p.e.copy()}
+}
+
 func (p *PrivateKey) decrypt(c *BigInt) *BigInt {
 	return pow(c, p.d, p.n)
 }
 
-func (p *PrivateKey) DecryptString(a string) []byte {
+func (p *PrivateKey) DecryptString(a string) ([]byte, error) {
 	encryptedArray, err := base64.StdEncoding.DecodeString(a)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrBadCiphertext, err)
 	}
 	splitStr := strings.Split(string(encryptedArray), ",")
 	decryptedString := make([]byte, 0)
 	for i := 0; i < len(splitStr); i++ {
+		if !isDecimal(splitStr[i]) {
+			return nil, fmt.Errorf("%w: part %d is not a decimal number", ErrBadCiphertext, i)
+		}
 		currentPart := p.decrypt(fromString(splitStr[i]))
+		if currentPart.compare(fromInt(255)) > 0 {
+			return nil, fmt.Errorf("%w: part %d does not decrypt to a byte", ErrBadCiphertext, i)
+		}
 		decryptedString = append(decryptedString, byte(currentPart.toInt()))
 	}
-	return decryptedString
+	return decryptedString, nil
+}
+
+// DecryptKey decrypts a key of exactly size bytes produced by
+// PublicKey.EncryptString. Unlike DecryptString it does the same amount of
+// work whether the payload is badly encoded, has the wrong number of parts or
+// decrypts to out of range values: every one of the size parts is decrypted,
+// malformed ones being replaced by a dummy value, and the outcome is only
+// checked once at the end. All failures are reported as ErrKeyTransport so
+// callers cannot tell them apart.
+func (p *PrivateKey) DecryptKey(a string, size int) ([]byte, error) {
+	ok := 1
+
+	encryptedArray, err := base64.StdEncoding.DecodeString(a)
+	if err != nil {
+		ok = 0
+	}
+	splitStr := strings.Split(string(encryptedArray), ",")
+	ok &= subtle.ConstantTimeEq(int32(len(splitStr)), int32(size))
+
+	key := make([]byte, size)
+	for i := 0; i < size; i++ {
+		part := "0"
+		// Parts encrypted under our small moduli never need more than 18
+		// digits, longer ones would only make the arithmetic slow.
+		if i < len(splitStr) && len(splitStr[i]) <= 18 && isDecimal(splitStr[i]) {
+			part = splitStr[i]
+		} else {
+			ok = 0
+		}
+		value := p.decrypt(fromString(part)).toInt()
+		ok &= subtle.ConstantTimeEq(int32(value>>8), 0)
+		key[i] = byte(value)
+	}
+
+	if ok != 1 {
+		return nil, ErrKeyTransport
+	}
+	return key, nil
+}
+
+// Sign signs digest with textbook RSA: the first 8 bytes of digest, read as
+// a big endian number and reduced modulo n, are raised to d. The signature is
+// that number in decimal. With moduli this small only about 33 bits of the
+// digest are signed, which is enough to tell a key holder from someone who
+// only knows the public key, not to resist a determined forger.
+func (p *PrivateKey) Sign(digest []byte) []byte {
+	return []byte(pow(digestToInt(digest, p.n), p.d, p.n).String())
+}
+
+// Verify checks a signature produced by PrivateKey.Sign for digest, and
+// reports ErrBadSignature if it does not match.
+func (p *PublicKey) Verify(digest []byte, signature []byte) error {
+	// Signatures are below n, so never longer than it.
+	if !isDecimal(string(signature)) || len(signature) > len(p.n.String()) {
+		return ErrBadSignature
+	}
+	s := fromString(string(signature))
+	if s.compare(p.n) >= 0 {
+		return ErrBadSignature
+	}
+	if pow(s, p.e, p.n).compare(digestToInt(digest, p.n)) != 0 {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// digestToInt returns the first 8 bytes of digest, zero padded, as a number
+// modulo n.
+func digestToInt(digest []byte, n *BigInt) *BigInt {
+	var head [8]byte
+	copy(head[:], digest)
+	_, r := fromString(strconv.FormatUint(binary.BigEndian.Uint64(head[:]), 10)).div(n)
+	return r
+}
+
+// isDecimal reports whether s is a non-empty string of decimal digits.
+func isDecimal(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 func (p *PrivateKey) String() string {
 	return fmt.Sprintf("<%s, %s>", p.n.String(), p.d.String())
 }
 
+// Marshal encodes the key as its three decimal numbers "n,d,e". Keys used
+// to be marshaled as "n,d", without the public exponent Public needs;
+// Unmarshal refuses that form, such keys have to be generated again.
 func (p *PrivateKey) Marshal() []byte {
-	return []byte(fmt.Sprintf("%s,%s", p.n.String(), p.d.String()))
+	return []byte(fmt.Sprintf("%s,%s,%s", p.n.String(), p.d.String(), p.e.String()))
 }
 
+// Unmarshal parses a key produced by Marshal.
 func (p *PrivateKey) Unmarshal(a []byte) error {
 	l := strings.Split(string(a), ",")
+	if len(l) == 2 {
+		return errors.New("private key lacks its public exponent: it predates the n,d,e format and must be generated again")
+	}
+	if len(l) != 3 || !isDecimal(l[0]) || !isDecimal(l[1]) || !isDecimal(l[2]) {
+		return errors.New("private key must be three decimal numbers")
+	}
 	p.n = fromString(l[0])
 	p.d = fromString(l[1])
+	p.e = fromString(l[2])
 	return nil
 }
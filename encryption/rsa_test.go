@@ -0,0 +1,96 @@
+package encryption
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPublicKeyJSON(t *testing.T) {
+	pub, _ := GenerateKeyPair()
+	data, err := json.Marshal(pub)
+	if err != nil {
+		t.Fatalf("json.Marshal(key) = %v", err)
+	}
+	var got PublicKey
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) = %v", data, err)
+	}
+	if got.String() != pub.String() {
+		t.Errorf("round trip = %s, want %s", got.String(), pub.String())
+	}
+}
+
+func TestPublicKeyJSONZero(t *testing.T) {
+	data, err := json.Marshal(PublicKey{})
+	if err != nil {
+		t.Fatalf("json.Marshal(zero key) = %v", err)
+	}
+	if string(data) != "null" {
+		t.Errorf("json.Marshal(zero key) = %s, want null", data)
+	}
+	var got PublicKey
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal(null) = %v", err)
+	}
+	if got.n != nil || got.e != nil {
+		t.Errorf("json.Unmarshal(null) = %s, want the zero key", got.String())
+	}
+}
+
+func TestPublicKeyUnmarshalJSONRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not a string", `12`},
+		{"not base64", `"!!!"`},
+		{"empty", `""`},
+		// base64 of "3233", a single number.
+		{"one number", `"MzIzMw=="`},
+		// base64 of "15,3": the modulus cannot hold a byte.
+		{"small modulus", `"MTUsMw=="`},
+		// base64 of "3233,4": an even exponent.
+		{"even exponent", `"MzIzMyw0"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p PublicKey
+			if err := json.Unmarshal([]byte(tt.data), &p); err == nil {
+				t.Errorf("json.Unmarshal(%s) accepted %s", tt.data, p.String())
+			}
+		})
+	}
+}
+
+func TestPrivateKeyPublic(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	derived := priv.Public()
+	if derived.String() != pub.String() {
+		t.Fatalf("Public() = %s, want %s", derived.String(), pub.String())
+	}
+	message := []byte("derived keys encrypt for the private key")
+	got, err := priv.DecryptString(derived.EncryptString(message))
+	if err != nil || string(got) != string(message) {
+		t.Errorf("DecryptString() = %q, %v, want %q", got, err, message)
+	}
+}
+
+func TestPrivateKeyMarshal(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	var got PrivateKey
+	if err := got.Unmarshal(priv.Marshal()); err != nil {
+		t.Fatalf("Unmarshal(%s) = %v", priv.Marshal(), err)
+	}
+	if derived := got.Public(); derived.String() != pub.String() {
+		t.Errorf("Public() of the unmarshaled key = %s, want %s", derived.String(), pub.String())
+	}
+
+	for _, data := range []string{
+		"", "1,2", "1,2,3,4", "1,x,3", "1,,3",
+	} {
+		var p PrivateKey
+		if err := p.Unmarshal([]byte(data)); err == nil {
+			t.Errorf("Unmarshal(%q) = nil, want an error", data)
+		}
+	}
+}
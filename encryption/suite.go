@@ -0,0 +1,113 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Suite identifies the construction protecting messages once the handshake
+// is complete. It is sent on the wire as a single byte.
+type Suite byte
+
+const (
+	SUITE_AES_256_CFB             Suite = 1
+	SUITE_AES_256_CBC_HMAC_SHA256 Suite = 2
+	// SUITE_NULL sends messages in the clear, for inspecting the protocol
+	// on the wire. It is not among the supported suites, and must only be
+	// negotiated when both ends explicitly allow it.
+	SUITE_NULL Suite = 255
+)
+
+// SupportedSuites lists the suites this package implements, most preferred
+// first.
+func SupportedSuites() []Suite {
+	return []Suite{SUITE_AES_256_CBC_HMAC_SHA256, SUITE_AES_256_CFB}
+}
+
+func (s Suite) Supported() bool {
+	for _, supported := range SupportedSuites() {
+		if s == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Suite) Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	return s.EncryptFrom(rand.Reader, key, plaintext)
+}
+
+// EncryptFrom is Encrypt drawing the IV from random.
+func (s Suite) EncryptFrom(random io.Reader, key []byte, plaintext []byte) ([]byte, error) {
+	switch s {
+	case SUITE_AES_256_CFB:
+		return encryptAES(random, key, plaintext)
+	case SUITE_AES_256_CBC_HMAC_SHA256:
+		return encryptAESCBCHMAC(random, key, plaintext)
+	case SUITE_NULL:
+		return append([]byte{}, plaintext...), nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %d", s)
+	}
+}
+
+func (s Suite) Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	switch s {
+	case SUITE_AES_256_CFB:
+		// DecryptAES works in place, keep the caller's ciphertext intact.
+		return DecryptAESInto(nil, key, ciphertext)
+	case SUITE_AES_256_CBC_HMAC_SHA256:
+		return DecryptAESCBCHMAC(key, ciphertext)
+	case SUITE_NULL:
+		return append([]byte{}, ciphertext...), nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %d", s)
+	}
+}
+
+// Security levels of the suites, higher being stronger. A level admits the
+// suites at or above it.
+const (
+	// SECURITY_CONFIDENTIAL suites encrypt messages without authenticating
+	// them: a tampered message decrypts to garbage instead of being rejected.
+	SECURITY_CONFIDENTIAL = 1
+	// SECURITY_AUTHENTICATED suites also authenticate every message.
+	SECURITY_AUTHENTICATED = 2
+)
+
+// SecurityLevel returns the level of the suite, zero for SUITE_NULL and
+// unsupported ones.
+func (s Suite) SecurityLevel() int {
+	switch s {
+	case SUITE_AES_256_CFB:
+		return SECURITY_CONFIDENTIAL
+	case SUITE_AES_256_CBC_HMAC_SHA256:
+		return SECURITY_AUTHENTICATED
+	default:
+		return 0
+	}
+}
+
+// ParseSuite returns the supported suite whose String is name.
+func ParseSuite(name string) (Suite, error) {
+	for _, suite := range SupportedSuites() {
+		if suite.String() == name {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+func (s Suite) String() string {
+	switch s {
+	case SUITE_AES_256_CFB:
+		return "AES-256-CFB"
+	case SUITE_AES_256_CBC_HMAC_SHA256:
+		return "AES-256-CBC-HMAC-SHA256"
+	case SUITE_NULL:
+		return "NULL"
+	default:
+		return fmt.Sprintf("unknown suite %d", s)
+	}
+}
@@ -0,0 +1,40 @@
+package encryption
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkSuites measures sealing and opening one message with each suite,
+// at chat sizes and at the size of a large message.
+func BenchmarkSuites(b *testing.B) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	for _, suite := range append(SupportedSuites(), SUITE_NULL) {
+		for _, size := range []int{16, 128, 4096} {
+			plaintext := make([]byte, size)
+			ciphertext, err := suite.Encrypt(key, plaintext)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/size=%d/encrypt", suite, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, err := suite.Encrypt(key, plaintext); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("%s/size=%d/decrypt", suite, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, err := suite.Decrypt(key, ciphertext); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
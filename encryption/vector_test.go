@@ -0,0 +1,71 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The vectors below were computed from this key, IV and plaintext with
+// OpenSSL (aes-256-cfb, aes-256-cbc) and Python's hmac module, not with this
+// package, so that a change to a construction cannot update its own vector.
+var (
+	vectorKey       = mustHex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	vectorIV        = mustHex("a0a1a2a3a4a5a6a7a8a9aaabacadaeaf")
+	vectorPlaintext = []byte("attack at dawn")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestCFBVector(t *testing.T) {
+	want := mustHex("a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" + "bdeb759c15d35c6c7b6b8ce47c65")
+	got, err := encryptAES(bytes.NewReader(vectorIV), vectorKey, vectorPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("encryptAES() = %x, want %x", got, want)
+	}
+	plaintext, err := DecryptAESInto(nil, vectorKey, want)
+	if err != nil || !bytes.Equal(plaintext, vectorPlaintext) {
+		t.Errorf("DecryptAESInto() = %q, %v, want %q", plaintext, err, vectorPlaintext)
+	}
+}
+
+func TestCBCHMACVector(t *testing.T) {
+	want := mustHex("a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" +
+		"d0754e8435547d4726bcba83272af6d2" +
+		"c9fa4cec6485db341cd24532adbb9405244ad96ee74da15827d281ea2b33cfd5")
+	got, err := encryptAESCBCHMAC(bytes.NewReader(vectorIV), vectorKey, vectorPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("encryptAESCBCHMAC() = %x, want %x", got, want)
+	}
+	plaintext, err := DecryptAESCBCHMAC(vectorKey, want)
+	if err != nil || !bytes.Equal(plaintext, vectorPlaintext) {
+		t.Errorf("DecryptAESCBCHMAC() = %q, %v, want %q", plaintext, err, vectorPlaintext)
+	}
+}
+
+func TestDeriveKeyVector(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"cbc encryption", "d2111969332afe82b82bae95e06f5a2a94e1f382b7571c189efa9ac75a631d1e"},
+		{"cbc authentication", "ba0ffce79ccfb6ad9e287a50f4deb47ab3aacaf3035db3d79408d31ff561dd0e"},
+	}
+	for _, tt := range tests {
+		if got := deriveKey(vectorKey, tt.label); hex.EncodeToString(got) != tt.want {
+			t.Errorf("deriveKey(%q) = %x, want %s", tt.label, got, tt.want)
+		}
+	}
+}
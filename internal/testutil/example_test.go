@@ -0,0 +1,31 @@
+package testutil_test
+
+import (
+	"fmt"
+	"io"
+
+	"safechat/internal/testutil"
+)
+
+func ExampleServeConn() {
+	client, server, err := testutil.NewLoopback()
+	if err != nil {
+		panic(err)
+	}
+	// An echo server.
+	done := testutil.ServeConn(server, func(conn io.ReadWriteCloser) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+
+	fmt.Fprint(client, "hello")
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		panic(err)
+	}
+	fmt.Println(string(reply))
+
+	client.Close()
+	<-done
+	// Output: hello
+}
@@ -0,0 +1,52 @@
+// Package testutil holds the wiring the tests of the other packages share.
+package testutil
+
+import (
+	"io"
+	"net"
+)
+
+// NewLoopback returns both ends of a TCP connection over the loopback
+// interface. Unlike a net.Pipe, the ends are *net.TCPConn, and writes are
+// buffered by the kernel rather than waiting for the peer to read.
+func NewLoopback() (client, server net.Conn, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = listener.Accept()
+		accepted <- err
+	}()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		<-accepted
+		if server != nil {
+			server.Close()
+		}
+		return nil, nil, err
+	}
+	if err := <-accepted; err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// ServeConn runs serve on conn in its own goroutine. The returned channel is
+// closed once serve returned, so that a test can wait for the server side to
+// be done before it looks at the server's state. Closing conn is up to
+// serve.
+func ServeConn(conn io.ReadWriteCloser, serve func(io.ReadWriteCloser)) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(conn)
+	}()
+	return done
+}
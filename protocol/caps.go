@@ -0,0 +1,35 @@
+package protocol
+
+import "errors"
+
+// Caps is the body of a SERVER_CAPS, the answer to a CLIENT_CAPS probe:
+//
+//	min version 1 byte
+//	max version 1 byte
+//	count       1 byte, the number of cipher suites supported
+//	suites      count bytes, one cipher suite id each, most preferred first
+type Caps struct {
+	MinVersion byte
+	MaxVersion byte
+	Suites     []byte
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (c Caps) MarshalBinary() ([]byte, error) {
+	if len(c.Suites) > 255 {
+		return nil, errors.New("too many cipher suites")
+	}
+	data := []byte{c.MinVersion, c.MaxVersion, byte(len(c.Suites))}
+	return append(data, c.Suites...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *Caps) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 || len(data) != 3+int(data[2]) {
+		return errors.New("malformed capabilities")
+	}
+	c.MinVersion = data[0]
+	c.MaxVersion = data[1]
+	c.Suites = append([]byte{}, data[3:]...)
+	return nil
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"crypto/sha256"
+
+	crypt "safechat/encryption"
+)
+
+// CHALLENGE_SIZE is the size of the random challenge a client sends in its
+// hello.
+const CHALLENGE_SIZE = 16
+
+// The server proves it holds the private key matching the public key in its
+// SERVER_HELLO by signing the client's challenge along with that key:
+//
+//	signature = sign(SHA-256(CHALLENGE_LABEL || challenge || public key))
+//
+// The challenge is fresh for every handshake, so a signature recorded from
+// an earlier one is of no use, and covering the key ties the signature to
+// the key it is checked against.
+const CHALLENGE_LABEL = "safechat challenge\x00"
+
+func challengeDigest(challenge, publicKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(CHALLENGE_LABEL))
+	h.Write(challenge)
+	h.Write(publicKey)
+	return h.Sum(nil)
+}
+
+// SignChallenge answers challenge for the server presenting publicKey, the
+// marshalled public half of priv.
+func SignChallenge(priv *crypt.PrivateKey, challenge, publicKey []byte) []byte {
+	return priv.Sign(challengeDigest(challenge, publicKey))
+}
+
+// VerifyChallenge checks the server's answer to challenge, pub being the key
+// it presented. It fails with crypt.ErrBadSignature for a server that does
+// not hold the matching private key, or did not answer at all.
+func VerifyChallenge(pub *crypt.PublicKey, challenge, signature []byte) error {
+	return pub.Verify(challengeDigest(challenge, pub.Marshal()), signature)
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+
+	crypt "safechat/encryption"
+)
+
+func TestVerifyChallenge(t *testing.T) {
+	pub, priv := crypt.GenerateKeyPair()
+	_, other := crypt.GenerateKeyPair()
+	challenge := []byte("0123456789abcdef")
+	otherChallenge := []byte("fedcba9876543210")
+
+	tests := []struct {
+		name      string
+		signature []byte
+		wantErr   bool
+	}{
+		{"holder of the private key", SignChallenge(&priv, challenge, pub.Marshal()), false},
+		{"server without the private key", SignChallenge(&other, challenge, pub.Marshal()), true},
+		{"replayed signature", SignChallenge(&priv, otherChallenge, pub.Marshal()), true},
+		{"no signature", nil, true},
+		{"not a number", []byte("12a"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyChallenge(&pub, challenge, tt.signature)
+			if tt.wantErr && !errors.Is(err, crypt.ErrBadSignature) {
+				t.Errorf("VerifyChallenge() = %v, want ErrBadSignature", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("VerifyChallenge() = %v, want nil", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// MAX_DUMP_SIZE is how many bytes of each read or write DumpConn prints.
+const MAX_DUMP_SIZE = 256
+
+// DumpConn wraps a connection and prints a hexdump of everything read from
+// and written to it. It is meant for debugging interop problems only, the
+// dumps include key material and message contents.
+type DumpConn struct {
+	net.Conn
+	// out is where the dumps go, the standard output.
+	out io.Writer
+}
+
+func NewDumpConn(conn net.Conn) *DumpConn {
+	return &DumpConn{Conn: conn, out: os.Stdout}
+}
+
+func (c *DumpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.dump("read", b[:n])
+	}
+	return n, err
+}
+
+func (c *DumpConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.dump("wrote", b[:n])
+	}
+	return n, err
+}
+
+func (c *DumpConn) dump(direction string, b []byte) {
+	if len(b) > MAX_DUMP_SIZE {
+		fmt.Fprintf(c.out, "[debug] %s %d bytes, showing the first %d:\n%s", direction, len(b), MAX_DUMP_SIZE, hex.Dump(b[:MAX_DUMP_SIZE]))
+		return
+	}
+	fmt.Fprintf(c.out, "[debug] %s %d bytes:\n%s", direction, len(b), hex.Dump(b))
+}
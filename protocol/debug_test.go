@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDumpConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	var out bytes.Buffer
+	conn := &DumpConn{Conn: server, out: &out}
+	defer conn.Close()
+
+	go client.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	want := "[debug] read 5 bytes:\n" + hex.Dump([]byte("hello"))
+	if out.String() != want {
+		t.Errorf("dump of a read = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	large := bytes.Repeat([]byte{0xab}, MAX_DUMP_SIZE+10)
+	go io.Copy(io.Discard, client)
+	if _, err := conn.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	want = "[debug] wrote 266 bytes, showing the first 256:\n" + hex.Dump(large[:MAX_DUMP_SIZE])
+	if out.String() != want {
+		t.Errorf("dump of a large write = %q, want %q", out.String(), want)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 1+MAX_DUMP_SIZE/16 {
+		t.Errorf("dump of a large write has %d lines, want %d", n, 1+MAX_DUMP_SIZE/16)
+	}
+}
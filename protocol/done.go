@@ -0,0 +1,54 @@
+package protocol
+
+import "strings"
+
+// Once the client sent its symmetric key, the rest of the handshake is
+// encrypted under it with the negotiated suite:
+//
+//	CLIENT_DONE  rsa(key) [":" encrypt(username [":" credential])]
+//	SERVER_DONE  encrypt(SERVER_FINISHED transcript)
+//
+// rsa(key) is what crypt.PublicKey.EncryptString produces for the 32 bytes
+// of the key: each byte encrypted on its own, written in decimal, joined with
+// commas and encoded in padded standard base64. A payload that does not
+// decode, or does not decrypt to exactly 32 bytes, is refused with
+// ERR_DECRYPT_FAILED.
+//
+// The username and the credential, such as a password, do not travel in the
+// clear. Usernames cannot contain ":", so the credential is whatever follows
+// the first one. A client that decrypts SERVER_FINISHED knows the server
+// ended up with the same key.
+//
+// transcript is the Transcript hash of CLIENT_HELLO, SERVER_HELLO and
+// CLIENT_DONE, 32 bytes. A client whose hash differs from the server's knows
+// someone altered the handshake, to strip the suites it prefers for instance.
+//
+// SERVER_FINISHED proves nothing about who owns the server's key pair.
+// EncryptString uses textbook RSA, one byte at a time, so anyone holding the
+// public key can encrypt the 256 byte values and read the key out of
+// CLIENT_DONE. Possession of the private key is proven by the signed
+// challenge in SERVER_HELLO instead, see SignChallenge, and clients must not
+// send CLIENT_DONE to a server whose signature does not verify.
+const SERVER_FINISHED = "server finished"
+
+// Once the session is established, CLIENT_CLOSE and SERVER_CLOSE carry
+// CloseNotify encrypted under the session key. Anyone on the path can cut
+// the TCP stream or inject a bare close, only the two ends can produce this,
+// so each tells a session its peer ended from a truncated one.
+const CLOSE_NOTIFY = "close notify"
+
+// CloseNotify returns the plaintext of a close record of recordType,
+// CLOSE_NOTIFY followed by the record type. Record headers are not
+// authenticated, and the server echoes CLIENT_MSG ciphertexts verbatim: the
+// type binds the notify to the direction it was sent in, so that none can be
+// relabeled as a close going the other way. For the same reason no message
+// may carry a notify, see IsCloseNotify.
+func CloseNotify(recordType byte) []byte {
+	return append([]byte(CLOSE_NOTIFY), recordType)
+}
+
+// IsCloseNotify reports whether plaintext is the CloseNotify of any record
+// type. Servers refuse such messages rather than echo them.
+func IsCloseNotify(plaintext []byte) bool {
+	return len(plaintext) == len(CLOSE_NOTIFY)+1 && strings.HasPrefix(string(plaintext), CLOSE_NOTIFY)
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Error codes carried by ERROR messages. The body of an ERROR is the code
+// (1 byte) followed by a human readable description and, once the client
+// sent one in its hello, a NUL byte and the correlation id.
+const (
+	ERR_MALFORMED_MESSAGE   byte = 1
+	ERR_UNSUPPORTED_VERSION byte = 2
+	ERR_HANDSHAKE_FAILED    byte = 3
+	ERR_UNEXPECTED_MESSAGE  byte = 4
+	ERR_DECRYPT_FAILED      byte = 5
+	ERR_MESSAGE_TOO_LARGE   byte = 6
+	ERR_INTERNAL_ERROR      byte = 7
+)
+
+// ErrorBody builds the body of an ERROR message, echoing correlationID
+// unless it is empty. Descriptions cannot hold a NUL byte, any is dropped.
+func ErrorBody(code byte, text string, correlationID []byte) []byte {
+	body := append([]byte{code}, strings.ReplaceAll(text, "\x00", "")...)
+	if len(correlationID) > 0 {
+		body = append(append(body, 0), correlationID...)
+	}
+	return body
+}
+
+// ParseErrorBody splits the body of an ERROR message into its code,
+// description and correlation id, nil when there is none.
+func ParseErrorBody(body []byte) (code byte, text string, correlationID []byte, err error) {
+	if len(body) == 0 {
+		return 0, "", nil, errors.New("error message without a code")
+	}
+	description, id, found := bytes.Cut(body[1:], []byte{0})
+	if found {
+		correlationID = append([]byte{}, id...)
+	}
+	return body[0], string(description), correlationID, nil
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzClientHelloUnmarshal(f *testing.F) {
+	f.Add(goldenClientHello[HEADER_SIZE:])
+	f.Add([]byte{})
+	f.Add([]byte{3, 1})
+	f.Add([]byte{1, 2, EXT_METADATA, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var hello ClientHello
+		if err := hello.UnmarshalBinary(data); err != nil {
+			return
+		}
+		// Unknown and empty extensions are dropped, so it is the encoding of
+		// the decoded hello that has to survive a round trip, not data.
+		encoded, err := hello.MarshalBinary()
+		if err != nil {
+			return
+		}
+		var again ClientHello
+		if err := again.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("UnmarshalBinary(%x) = %v after encoding %+v", encoded, err, hello)
+		}
+		if reencoded, err := again.MarshalBinary(); err != nil || !bytes.Equal(reencoded, encoded) {
+			t.Fatalf("MarshalBinary() = %x, %v after decoding %x", reencoded, err, encoded)
+		}
+	})
+}
+
+func FuzzServerHelloUnmarshal(f *testing.F) {
+	f.Add(goldenServerHello[HEADER_SIZE:])
+	f.Add([]byte{2, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var hello ServerHello
+		if err := hello.UnmarshalBinary(data); err != nil {
+			return
+		}
+		encoded, err := hello.MarshalBinary()
+		if err != nil {
+			return
+		}
+		var again ServerHello
+		if err := again.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("UnmarshalBinary(%x) = %v after encoding %+v", encoded, err, hello)
+		}
+		if reencoded, err := again.MarshalBinary(); err != nil || !bytes.Equal(reencoded, encoded) {
+			t.Fatalf("MarshalBinary() = %x, %v after decoding %x", reencoded, err, encoded)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The frames below are written out byte for byte, and must not change: other
+// implementations decode exactly these bytes.
+
+var goldenClientHello = []byte{
+	0x00,                   // header, CLIENT_HELLO
+	0x01,                   // version
+	0x00, 0x00, 0x00, 0x0f, // body length, 15 bytes
+	0x02,       // suite count
+	0x02, 0x01, // suites, CBC-HMAC then CFB
+	0x01, 0x00, 0x00, // EXT_REQUEST_ACKS, no data
+	0x03, 0x00, 0x03, 'a', 'b', 'c', // EXT_CORRELATION_ID, "abc"
+	0x2a, 0x00, 0x00, // unknown extension, skipped
+}
+
+var goldenServerHello = []byte{
+	0x01,                   // header, SERVER_HELLO
+	0x01,                   // version
+	0x00, 0x00, 0x00, 0x12, // body length, 18 bytes
+	0x02,       // suite, CBC-HMAC
+	0x00, 0x06, // public key length
+	'3', '2', '3', '3', ',', '7', // public key
+	0x04, 0x00, 0x06, 's', 'c', '/', '1', '.', '2', // EXT_SERVER_NAME, "sc/1.2"
+}
+
+var goldenCaps = []byte{
+	0x0b,                   // header, SERVER_CAPS
+	0x01,                   // version
+	0x00, 0x00, 0x00, 0x05, // body length, 5 bytes
+	0x01, 0x01, // versions 1 to 1
+	0x02,       // suite count
+	0x02, 0x01, // suites
+}
+
+var goldenError = []byte{
+	0x04,                   // header, ERROR
+	0x01,                   // version
+	0x00, 0x00, 0x00, 0x03, // body length, 3 bytes
+	0x03,     // ERR_HANDSHAKE_FAILED
+	'n', 'o', // description
+}
+
+var goldenCorrelatedError = []byte{
+	0x04,                   // header, ERROR
+	0x01,                   // version
+	0x00, 0x00, 0x00, 0x07, // body length, 7 bytes
+	0x05,     // ERR_DECRYPT_FAILED
+	'n', 'o', // description
+	0x00,          // end of the description
+	'a', 'b', 'c', // correlation id
+}
+
+func decodeGolden(t *testing.T, frame []byte, header byte) Message {
+	t.Helper()
+	msg, err := ReadRecord(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("ReadRecord(%x) = %v", frame, err)
+	}
+	if msg.Header != header || msg.Version != VERSION {
+		t.Fatalf("ReadRecord(%x) = header %d version %d, want %d and %d", frame, msg.Header, msg.Version, header, VERSION)
+	}
+	return msg
+}
+
+// encodeGolden checks that body frames back into frame.
+func encodeGolden(t *testing.T, frame []byte, header byte, body []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteRecord(&buf, header, body); err != nil {
+		t.Fatalf("WriteRecord() = %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), frame) {
+		t.Errorf("WriteRecord() = %x, want %x", buf.Bytes(), frame)
+	}
+}
+
+func TestGoldenClientHello(t *testing.T) {
+	msg := decodeGolden(t, goldenClientHello, 0)
+	var hello ClientHello
+	if err := hello.UnmarshalBinary(msg.Body); err != nil {
+		t.Fatalf("ClientHello.UnmarshalBinary() = %v", err)
+	}
+	if !bytes.Equal(hello.Suites, []byte{2, 1}) || !hello.RequestAcks || string(hello.CorrelationID) != "abc" {
+		t.Errorf("ClientHello = %+v", hello)
+	}
+	if hello.Metadata != nil || hello.Challenge != nil {
+		t.Errorf("ClientHello = %+v, want no metadata nor challenge", hello)
+	}
+
+	// The unknown extension is not kept, so the encoding ends before it.
+	body, err := hello.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, msg.Body[:len(msg.Body)-3]) {
+		t.Errorf("ClientHello.MarshalBinary() = %x, want %x", body, msg.Body[:len(msg.Body)-3])
+	}
+}
+
+func TestGoldenServerHello(t *testing.T) {
+	msg := decodeGolden(t, goldenServerHello, 1)
+	var hello ServerHello
+	if err := hello.UnmarshalBinary(msg.Body); err != nil {
+		t.Fatalf("ServerHello.UnmarshalBinary() = %v", err)
+	}
+	if hello.Suite != 2 || string(hello.PublicKey) != "3233,7" || hello.ServerName != "sc/1.2" {
+		t.Errorf("ServerHello = %+v", hello)
+	}
+	body, err := hello.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeGolden(t, goldenServerHello, 1, body)
+}
+
+func TestGoldenCaps(t *testing.T) {
+	msg := decodeGolden(t, goldenCaps, 11)
+	var caps Caps
+	if err := caps.UnmarshalBinary(msg.Body); err != nil {
+		t.Fatalf("Caps.UnmarshalBinary() = %v", err)
+	}
+	if caps.MinVersion != 1 || caps.MaxVersion != 1 || !bytes.Equal(caps.Suites, []byte{2, 1}) {
+		t.Errorf("Caps = %+v", caps)
+	}
+	body, err := caps.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeGolden(t, goldenCaps, 11, body)
+}
+
+func TestGoldenError(t *testing.T) {
+	msg := decodeGolden(t, goldenError, 4)
+	code, text, correlationID, err := ParseErrorBody(msg.Body)
+	if err != nil || code != ERR_HANDSHAKE_FAILED || text != "no" || correlationID != nil {
+		t.Errorf("ParseErrorBody() = %d, %q, %q, %v", code, text, correlationID, err)
+	}
+	encodeGolden(t, goldenError, 4, ErrorBody(ERR_HANDSHAKE_FAILED, "no", nil))
+}
+
+func TestGoldenCorrelatedError(t *testing.T) {
+	msg := decodeGolden(t, goldenCorrelatedError, 4)
+	code, text, correlationID, err := ParseErrorBody(msg.Body)
+	if err != nil || code != ERR_DECRYPT_FAILED || text != "no" || string(correlationID) != "abc" {
+		t.Errorf("ParseErrorBody() = %d, %q, %q, %v", code, text, correlationID, err)
+	}
+	encodeGolden(t, goldenCorrelatedError, 4, ErrorBody(ERR_DECRYPT_FAILED, "no", []byte("abc")))
+}
+
+func TestErrorBodyDropsNUL(t *testing.T) {
+	body := ErrorBody(ERR_HANDSHAKE_FAILED, "bad\x00name", []byte("a\x00b"))
+	code, text, correlationID, err := ParseErrorBody(body)
+	if err != nil || code != ERR_HANDSHAKE_FAILED || text != "badname" || string(correlationID) != "a\x00b" {
+		t.Errorf("ParseErrorBody(%x) = %d, %q, %q, %v", body, code, text, correlationID, err)
+	}
+}
@@ -0,0 +1,252 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Extensions that may end a CLIENT_HELLO or a SERVER_HELLO. Each one is
+// encoded as its type (1 byte), the length of its data (2 bytes, big endian)
+// and the data itself. Receivers skip extensions they do not know.
+const (
+	EXT_REQUEST_ACKS   byte = 1
+	EXT_METADATA       byte = 2
+	EXT_CORRELATION_ID byte = 3
+	EXT_SERVER_NAME    byte = 4
+	EXT_CHALLENGE      byte = 5
+	EXT_KEEPALIVE      byte = 6
+)
+
+// MAX_METADATA_SIZE caps the opaque metadata a client may attach to its
+// hello.
+const MAX_METADATA_SIZE = 256
+
+// MAX_CORRELATION_ID_SIZE caps the correlation id a client may attach to its
+// hello.
+const MAX_CORRELATION_ID_SIZE = 16
+
+// MAX_SERVER_NAME_SIZE caps the name a server may advertise in its hello.
+const MAX_SERVER_NAME_SIZE = 64
+
+// MAX_KEEPALIVE_PERIOD is the longest keepalive period a hello can carry, it
+// travels in whole seconds on 2 bytes.
+const MAX_KEEPALIVE_PERIOD = 0xffff * time.Second
+
+// ClientHello is the body of a CLIENT_HELLO:
+//
+//	count      1 byte, the number of cipher suites offered
+//	suites     count bytes, one cipher suite id each, most preferred first
+//	extensions until the end of the body
+//
+// An empty body is a hello from a client that predates negotiation.
+type ClientHello struct {
+	Suites []byte
+	// RequestAcks asks the server to answer each CLIENT_MSG with a SERVER_ACK
+	// instead of echoing it.
+	RequestAcks bool
+	// Metadata is an opaque application payload, such as the client's
+	// version or locale, of at most MAX_METADATA_SIZE bytes.
+	Metadata []byte
+	// CorrelationID is a short token, of at most MAX_CORRELATION_ID_SIZE
+	// bytes, that the server echoes in its hello and tags its logs with.
+	CorrelationID []byte
+	// Challenge is CHALLENGE_SIZE random bytes the server must sign, see
+	// SignChallenge.
+	Challenge []byte
+	// KeepAlive is the TCP keepalive period the client would like for the
+	// session, in whole seconds, zero leaving it to the server.
+	KeepAlive time.Duration
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (h ClientHello) MarshalBinary() ([]byte, error) {
+	if len(h.Suites) > 255 {
+		return nil, errors.New("too many cipher suites")
+	}
+	data := []byte{byte(len(h.Suites))}
+	data = append(data, h.Suites...)
+	if h.RequestAcks {
+		data = appendExtension(data, EXT_REQUEST_ACKS, nil)
+	}
+	if len(h.Metadata) > MAX_METADATA_SIZE {
+		return nil, fmt.Errorf("metadata larger than %d bytes", MAX_METADATA_SIZE)
+	}
+	if len(h.Metadata) > 0 {
+		data = appendExtension(data, EXT_METADATA, h.Metadata)
+	}
+	if len(h.CorrelationID) > MAX_CORRELATION_ID_SIZE {
+		return nil, fmt.Errorf("correlation id larger than %d bytes", MAX_CORRELATION_ID_SIZE)
+	}
+	if len(h.CorrelationID) > 0 {
+		data = appendExtension(data, EXT_CORRELATION_ID, h.CorrelationID)
+	}
+	if h.Challenge != nil && len(h.Challenge) != CHALLENGE_SIZE {
+		return nil, fmt.Errorf("challenge must be %d bytes", CHALLENGE_SIZE)
+	}
+	if h.Challenge != nil {
+		data = appendExtension(data, EXT_CHALLENGE, h.Challenge)
+	}
+	if h.KeepAlive != 0 {
+		ext, err := marshalKeepAlive(h.KeepAlive)
+		if err != nil {
+			return nil, err
+		}
+		data = appendExtension(data, EXT_KEEPALIVE, ext)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (h *ClientHello) UnmarshalBinary(data []byte) error {
+	*h = ClientHello{}
+	if len(data) == 0 {
+		return nil
+	}
+	count := int(data[0])
+	if len(data) < 1+count {
+		return errors.New("client hello truncated in its suite list")
+	}
+	h.Suites = append([]byte{}, data[1:1+count]...)
+
+	return parseExtensions(data[1+count:], func(typ byte, ext []byte) {
+		switch typ {
+		case EXT_REQUEST_ACKS:
+			h.RequestAcks = true
+		case EXT_METADATA:
+			h.Metadata = ext
+		case EXT_CORRELATION_ID:
+			h.CorrelationID = ext
+		case EXT_CHALLENGE:
+			h.Challenge = ext
+		case EXT_KEEPALIVE:
+			h.KeepAlive = unmarshalKeepAlive(ext)
+		}
+	})
+}
+
+// ServerHello is the body of a SERVER_HELLO:
+//
+//	suite      1 byte, the cipher suite the server picked
+//	length     2 bytes, big endian, the length of the public key
+//	key        length bytes, the marshalled public key of the server
+//	extensions until the end of the body
+type ServerHello struct {
+	Suite     byte
+	PublicKey []byte
+	// CorrelationID echoes the one the client sent in its hello, if any.
+	CorrelationID []byte
+	// ServerName is the name and version the server advertises, such as
+	// "safechat/1.2", of at most MAX_SERVER_NAME_SIZE bytes.
+	ServerName string
+	// ChallengeSignature answers the client's challenge, if it sent one.
+	ChallengeSignature []byte
+	// KeepAlive is the keepalive period the server settled on for the
+	// session, set only when the client proposed one.
+	KeepAlive time.Duration
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (h ServerHello) MarshalBinary() ([]byte, error) {
+	if len(h.PublicKey) > 0xffff {
+		return nil, errors.New("public key too large")
+	}
+	data := []byte{h.Suite, 0, 0}
+	binary.BigEndian.PutUint16(data[1:3], uint16(len(h.PublicKey)))
+	data = append(data, h.PublicKey...)
+	if len(h.CorrelationID) > MAX_CORRELATION_ID_SIZE {
+		return nil, fmt.Errorf("correlation id larger than %d bytes", MAX_CORRELATION_ID_SIZE)
+	}
+	if len(h.CorrelationID) > 0 {
+		data = appendExtension(data, EXT_CORRELATION_ID, h.CorrelationID)
+	}
+	if len(h.ServerName) > MAX_SERVER_NAME_SIZE {
+		return nil, fmt.Errorf("server name larger than %d bytes", MAX_SERVER_NAME_SIZE)
+	}
+	if h.ServerName != "" {
+		data = appendExtension(data, EXT_SERVER_NAME, []byte(h.ServerName))
+	}
+	if len(h.ChallengeSignature) > 0 {
+		data = appendExtension(data, EXT_CHALLENGE, h.ChallengeSignature)
+	}
+	if h.KeepAlive != 0 {
+		ext, err := marshalKeepAlive(h.KeepAlive)
+		if err != nil {
+			return nil, err
+		}
+		data = appendExtension(data, EXT_KEEPALIVE, ext)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (h *ServerHello) UnmarshalBinary(data []byte) error {
+	*h = ServerHello{}
+	if len(data) < 3 {
+		return errors.New("server hello shorter than its header")
+	}
+	h.Suite = data[0]
+	length := int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < 3+length {
+		return errors.New("server hello truncated in its public key")
+	}
+	h.PublicKey = append([]byte{}, data[3:3+length]...)
+
+	return parseExtensions(data[3+length:], func(typ byte, ext []byte) {
+		switch typ {
+		case EXT_CORRELATION_ID:
+			h.CorrelationID = ext
+		case EXT_SERVER_NAME:
+			h.ServerName = string(ext)
+		case EXT_CHALLENGE:
+			h.ChallengeSignature = ext
+		case EXT_KEEPALIVE:
+			h.KeepAlive = unmarshalKeepAlive(ext)
+		}
+	})
+}
+
+// parseExtensions walks the extensions in data and hands each one to fn. The
+// data given to fn is a copy.
+func parseExtensions(data []byte, fn func(typ byte, ext []byte)) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errors.New("hello truncated in an extension header")
+		}
+		typ := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return errors.New("hello truncated in an extension")
+		}
+		fn(typ, append([]byte{}, data[3:3+length]...))
+		data = data[3+length:]
+	}
+	return nil
+}
+
+// marshalKeepAlive encodes a keepalive period as the seconds it counts, 2
+// bytes big endian.
+func marshalKeepAlive(period time.Duration) ([]byte, error) {
+	if period < time.Second || period > MAX_KEEPALIVE_PERIOD || period%time.Second != 0 {
+		return nil, fmt.Errorf("keepalive period %v is not a whole number of seconds between 1s and %v", period, MAX_KEEPALIVE_PERIOD)
+	}
+	ext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ext, uint16(period/time.Second))
+	return ext, nil
+}
+
+// unmarshalKeepAlive decodes what marshalKeepAlive encoded. An extension of
+// the wrong size counts as no period at all.
+func unmarshalKeepAlive(ext []byte) time.Duration {
+	if len(ext) != 2 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint16(ext)) * time.Second
+}
+
+func appendExtension(data []byte, typ byte, ext []byte) []byte {
+	data = append(data, typ, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(ext)))
+	return append(data, ext...)
+}
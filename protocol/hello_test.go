@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestClientHelloMetadata(t *testing.T) {
+	for _, size := range []int{1, MAX_METADATA_SIZE} {
+		metadata := bytes.Repeat([]byte{0xa5}, size)
+		data, err := ClientHello{Suites: []byte{1}, Metadata: metadata}.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%d bytes: MarshalBinary() = %v", size, err)
+		}
+		var hello ClientHello
+		if err := hello.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%d bytes: UnmarshalBinary() = %v", size, err)
+		}
+		if !bytes.Equal(hello.Metadata, metadata) {
+			t.Errorf("%d bytes: metadata came back as %x", size, hello.Metadata)
+		}
+	}
+	oversize := ClientHello{Metadata: make([]byte, MAX_METADATA_SIZE+1)}
+	if _, err := oversize.MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary() accepted %d bytes of metadata", MAX_METADATA_SIZE+1)
+	}
+}
+
+func TestHelloKeepAlive(t *testing.T) {
+	data, err := ClientHello{Suites: []byte{1}, KeepAlive: 15 * time.Second}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client ClientHello
+	if err := client.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if client.KeepAlive != 15*time.Second {
+		t.Errorf("client hello keepalive came back as %v, want 15s", client.KeepAlive)
+	}
+
+	data, err = ServerHello{Suite: 1, KeepAlive: MAX_KEEPALIVE_PERIOD}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server ServerHello
+	if err := server.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if server.KeepAlive != MAX_KEEPALIVE_PERIOD {
+		t.Errorf("server hello keepalive came back as %v, want %v", server.KeepAlive, MAX_KEEPALIVE_PERIOD)
+	}
+
+	for _, period := range []time.Duration{-time.Second, time.Millisecond, 1500 * time.Millisecond, MAX_KEEPALIVE_PERIOD + time.Second} {
+		if _, err := (ClientHello{KeepAlive: period}).MarshalBinary(); err == nil {
+			t.Errorf("MarshalBinary() accepted a keepalive period of %v", period)
+		}
+	}
+}
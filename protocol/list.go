@@ -0,0 +1,9 @@
+package protocol
+
+// Once the session is established, a client may ask who else is connected
+// with a CLIENT_LIST, whose body is ignored. The server answers with a
+// SERVER_LIST carrying, encrypted under the session key, the usernames of the
+// established sessions separated by PARTICIPANT_DELIM, including the client's
+// own. Anonymous sessions are not listed. A server configured to keep this
+// private answers with ERR_UNEXPECTED_MESSAGE instead.
+const PARTICIPANT_DELIM = "\n"
@@ -0,0 +1,98 @@
+// Package protocol holds the wire format shared by the safechat server and
+// client.
+//
+// Every message is framed as:
+//
+//	header  1 byte, what the message is (CLIENT_HELLO, SERVER_MSG, ...)
+//	version 1 byte, the protocol version the sender speaks
+//	length  4 bytes, big endian, the size of the body
+//	body    length bytes
+//
+// The same rules hold for every body: multi-byte integers are big endian,
+// fields follow each other in a fixed order without padding or alignment,
+// and variable-sized fields are preceded by their length. Decoders reject
+// data cut short of what its lengths announce.
+//
+// The body of each message, by header:
+//
+//	0  CLIENT_HELLO  ClientHello, or empty from clients predating negotiation
+//	1  SERVER_HELLO  ServerHello
+//	2  CLIENT_DONE   see SERVER_FINISHED
+//	3  SERVER_DONE   see SERVER_FINISHED
+//	4  ERROR         code (1 byte), description and correlation id, see ErrorBody
+//	5  CLIENT_MSG    ciphertext under the negotiated suite, never of a CloseNotify
+//	6  SERVER_MSG    the CLIENT_MSG ciphertext, echoed
+//	7  CLIENT_CLOSE  empty, or see CLOSE_NOTIFY once the session is established
+//	8  SERVER_CLOSE  empty, or see CLOSE_NOTIFY once the session is established
+//	9  SERVER_ACK    sequence number (8 bytes) of the acknowledged CLIENT_MSG
+//	10 CLIENT_CAPS   empty
+//	11 SERVER_CAPS   Caps
+//	12 CLIENT_LIST   ignored, see PARTICIPANT_DELIM
+//	13 SERVER_LIST   see PARTICIPANT_DELIM
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// VERSION is the protocol version spoken by this implementation.
+const VERSION byte = 1
+
+// HEADER_SIZE is the size of the framing that precedes every body.
+const HEADER_SIZE = 6
+
+// Message is a single framed protocol message.
+type Message struct {
+	Header  byte
+	Version byte
+	Body    []byte
+}
+
+// NewMessage returns a message of the current protocol version.
+func NewMessage(header byte, body []byte) Message {
+	return Message{
+		Header:  header,
+		Version: VERSION,
+		Body:    body,
+	}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (m Message) MarshalBinary() ([]byte, error) {
+	if uint64(len(m.Body)) > uint64(^uint32(0)) {
+		return nil, errors.New("message body too large")
+	}
+	data := make([]byte, HEADER_SIZE, HEADER_SIZE+len(m.Body))
+	data[0] = m.Header
+	data[1] = m.Version
+	binary.BigEndian.PutUint32(data[2:HEADER_SIZE], uint32(len(m.Body)))
+	return append(data, m.Body...), nil
+}
+
+// FrameLength returns the size, framing included, of the message starting
+// at data as announced by its header. data may hold only part of the
+// message, or more than one message.
+func FrameLength(data []byte) (int, error) {
+	if len(data) < HEADER_SIZE {
+		return 0, errors.New("message shorter than its header")
+	}
+	return HEADER_SIZE + int(binary.BigEndian.Uint32(data[2:HEADER_SIZE])), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. data must hold
+// exactly one message. The body is copied, so data may be reused afterwards.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if len(data) < HEADER_SIZE {
+		return errors.New("message shorter than its header")
+	}
+	length := binary.BigEndian.Uint32(data[2:HEADER_SIZE])
+	if uint64(len(data)-HEADER_SIZE) != uint64(length) {
+		return fmt.Errorf("message announces a %d bytes body but carries %d", length, len(data)-HEADER_SIZE)
+	}
+	m.Header = data[0]
+	m.Version = data[1]
+	m.Body = append([]byte{}, data[HEADER_SIZE:]...)
+	return nil
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Headers as numbered in the package documentation.
+const (
+	testClientHello byte = 0
+	testClientMsg   byte = 5
+	testServerCaps  byte = 11
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []Message{
+		NewMessage(testClientHello, nil),
+		NewMessage(testClientMsg, []byte("hello")),
+		{Header: testServerCaps, Version: VERSION + 1, Body: bytes.Repeat([]byte{0xff}, 300)},
+	}
+	for _, msg := range tests {
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%v) = %v", msg, err)
+		}
+		if len(data) != HEADER_SIZE+len(msg.Body) {
+			t.Errorf("MarshalBinary(%v) is %d bytes, want %d", msg, len(data), HEADER_SIZE+len(msg.Body))
+		}
+		if n, err := FrameLength(data); err != nil || n != len(data) {
+			t.Errorf("FrameLength(%v) = %d, %v, want %d", msg, n, err, len(data))
+		}
+		var got Message
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary(%x) = %v", data, err)
+		}
+		if got.Header != msg.Header || got.Version != msg.Version || !bytes.Equal(got.Body, msg.Body) {
+			t.Errorf("round trip = %v, want %v", got, msg)
+		}
+	}
+}
+
+func TestMessageUnmarshalCopiesBody(t *testing.T) {
+	data := []byte{testClientMsg, VERSION, 0, 0, 0, 2, 'h', 'i'}
+	var msg Message
+	if err := msg.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	data[HEADER_SIZE] = 'X'
+	if string(msg.Body) != "hi" {
+		t.Errorf("Body = %q after reusing data, want %q", msg.Body, "hi")
+	}
+}
+
+func TestMessageUnmarshalRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{testClientMsg, VERSION, 0, 0, 0}},
+		{"short body", []byte{testClientMsg, VERSION, 0, 0, 0, 3, 'h', 'i'}},
+		{"trailing bytes", []byte{testClientMsg, VERSION, 0, 0, 0, 1, 'h', 'i'}},
+		{"huge length", []byte{testClientMsg, VERSION, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg Message
+			if err := msg.UnmarshalBinary(tt.data); err == nil {
+				t.Errorf("UnmarshalBinary(%x) accepted %v", tt.data, msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+)
+
+// MAX_RECORD_SIZE bounds the body of a record, so that a peer cannot make
+// us allocate arbitrary amounts of memory.
+const MAX_RECORD_SIZE = 1024 * 1024
+
+var ErrRecordTooLarge = errors.New("record larger than MAX_RECORD_SIZE")
+
+// SMALL_RECORD_SIZE is the largest body ReadRecord reads into the buffer it
+// read the header into. Chat messages are mostly this small, and per record
+// allocations are what their cost comes down to.
+const SMALL_RECORD_SIZE = 128
+
+// ReadRecord reads exactly one record from r. Bytes that follow it are left
+// unread, so records that arrive back to back are read one after the other.
+// If r reaches EOF before a record even started, the error is io.EOF.
+func ReadRecord(r io.Reader) (Message, error) {
+	return readRecord(r, make([]byte, HEADER_SIZE, HEADER_SIZE+SMALL_RECORD_SIZE))
+}
+
+// readRecord is ReadRecord reading the header into buf, which must be
+// HEADER_SIZE long. A record that fits in the capacity of buf is read into
+// it, taking no other allocation, a larger one into a buffer of its own. The
+// body returned is part of that buffer.
+func readRecord(r io.Reader, buf []byte) (Message, error) {
+	var msg Message
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return msg, err
+	}
+	frameLen, err := FrameLength(buf)
+	if err != nil {
+		return msg, err
+	}
+	if frameLen-HEADER_SIZE > MAX_RECORD_SIZE {
+		return msg, ErrRecordTooLarge
+	}
+	var frame []byte
+	if frameLen <= cap(buf) {
+		frame = buf[:frameLen]
+	} else {
+		frame = make([]byte, frameLen)
+		copy(frame, buf)
+	}
+	if _, err := io.ReadFull(r, frame[HEADER_SIZE:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return msg, err
+	}
+	msg.Header = frame[0]
+	msg.Version = frame[1]
+	msg.Body = frame[HEADER_SIZE:]
+	return msg, nil
+}
+
+// WriteRecord writes a record of the current protocol version to w. A record
+// is only ever written whole, or an error is returned.
+func WriteRecord(w io.Writer, recordType byte, payload []byte) error {
+	if len(payload) > MAX_RECORD_SIZE {
+		return ErrRecordTooLarge
+	}
+	data, err := NewMessage(recordType, payload).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeAll(w, data)
+}
+
+// writeAll writes data to w, going on after short writes. Writers are meant
+// to fail when they write less than asked, not every wrapper around a
+// connection does.
+func writeAll(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
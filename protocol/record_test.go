@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestRecordsBackToBack(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{[]byte("first"), nil, []byte("third")}
+	for i, payload := range payloads {
+		if err := WriteRecord(&buf, byte(i), payload); err != nil {
+			t.Fatalf("WriteRecord(%q) = %v", payload, err)
+		}
+	}
+	for i, payload := range payloads {
+		msg, err := ReadRecord(&buf)
+		if err != nil {
+			t.Fatalf("ReadRecord() = %v, want %q", err, payload)
+		}
+		if msg.Header != byte(i) || msg.Version != VERSION || !bytes.Equal(msg.Body, payload) {
+			t.Errorf("ReadRecord() = %v, want type %d and %q", msg, i, payload)
+		}
+	}
+	if _, err := ReadRecord(&buf); err != io.EOF {
+		t.Errorf("ReadRecord() at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadRecordTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRecord(&buf, testClientMsg, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, n := range []int{1, HEADER_SIZE - 1, HEADER_SIZE, len(data) - 1} {
+		if _, err := ReadRecord(bytes.NewReader(data[:n])); err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadRecord(%d of %d bytes) = %v, want io.ErrUnexpectedEOF", n, len(data), err)
+		}
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	if err := WriteRecord(io.Discard, testClientMsg, make([]byte, MAX_RECORD_SIZE+1)); err != ErrRecordTooLarge {
+		t.Errorf("WriteRecord(MAX_RECORD_SIZE+1) = %v, want ErrRecordTooLarge", err)
+	}
+
+	// The size is checked before the body is read, or allocated.
+	header := []byte{testClientMsg, VERSION, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[2:], MAX_RECORD_SIZE+1)
+	if _, err := ReadRecord(bytes.NewReader(header)); err != ErrRecordTooLarge {
+		t.Errorf("ReadRecord(MAX_RECORD_SIZE+1) = %v, want ErrRecordTooLarge", err)
+	}
+}
+
+// shortWriter writes at most one byte per call.
+type shortWriter struct {
+	bytes.Buffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.Buffer.Write(p[:1])
+}
+
+// stuckWriter never writes anything, nor fails.
+type stuckWriter struct{}
+
+func (stuckWriter) Write(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestWriteRecordShortWrites(t *testing.T) {
+	var w shortWriter
+	if err := WriteRecord(&w, testClientMsg, []byte("hello")); err != nil {
+		t.Fatalf("WriteRecord() = %v", err)
+	}
+	msg, err := ReadRecord(&w)
+	if err != nil || string(msg.Body) != "hello" {
+		t.Errorf("ReadRecord() = %v, %v, want %q", msg, err, "hello")
+	}
+
+	if err := WriteRecord(stuckWriter{}, testClientMsg, []byte("hello")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("WriteRecord() to a stuck writer = %v, want io.ErrShortWrite", err)
+	}
+}
+
+func TestReadRecordSmallAndLarge(t *testing.T) {
+	for _, size := range []int{0, 1, SMALL_RECORD_SIZE - 1, SMALL_RECORD_SIZE, SMALL_RECORD_SIZE + 1, 4 * SMALL_RECORD_SIZE} {
+		payload := bytes.Repeat([]byte{0xa5}, size)
+		var buf bytes.Buffer
+		WriteRecord(&buf, testClientMsg, payload)
+		WriteRecord(&buf, testClientMsg, []byte("next"))
+		data := buf.Bytes()
+
+		// Both paths read the same record, whatever its size.
+		small, err := ReadRecord(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d bytes: ReadRecord() = %v", size, err)
+		}
+		general, err := readRecord(bytes.NewReader(data), make([]byte, HEADER_SIZE))
+		if err != nil {
+			t.Fatalf("%d bytes: readRecord() = %v", size, err)
+		}
+		for _, msg := range []Message{small, general} {
+			if msg.Header != testClientMsg || msg.Version != VERSION || !bytes.Equal(msg.Body, payload) {
+				t.Errorf("%d bytes: read type %d version %d and %d bytes", size, msg.Header, msg.Version, len(msg.Body))
+			}
+		}
+
+		// Records read one after the other do not share their bodies.
+		r := bytes.NewReader(data)
+		first, _ := ReadRecord(r)
+		second, _ := ReadRecord(r)
+		if string(second.Body) != "next" || !bytes.Equal(first.Body, payload) {
+			t.Errorf("%d bytes: reading the next record changed the first to %d bytes", size, len(first.Body))
+		}
+	}
+}
+
+// benchmarkReadRecord reads records of size bytes with read.
+func benchmarkReadRecord(b *testing.B, size int, read func(io.Reader) (Message, error)) {
+	var buf bytes.Buffer
+	WriteRecord(&buf, testClientMsg, make([]byte, size))
+	data := buf.Bytes()
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if _, err := read(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadRecord compares ReadRecord with the path records too large to
+// share the header's buffer take, which every record took before.
+func BenchmarkReadRecord(b *testing.B) {
+	general := func(r io.Reader) (Message, error) {
+		return readRecord(r, make([]byte, HEADER_SIZE))
+	}
+	for _, size := range []int{16, 64, SMALL_RECORD_SIZE, 4096} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			benchmarkReadRecord(b, size, ReadRecord)
+		})
+		b.Run(fmt.Sprintf("size=%d/general", size), func(b *testing.B) {
+			benchmarkReadRecord(b, size, general)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	crypt "safechat/encryption"
+)
+
+// MAX_SECURE_CHUNK_SIZE is the most plaintext SecureConn puts in one record,
+// well under what servers accept in a single message by default.
+const MAX_SECURE_CHUNK_SIZE = 1024
+
+// The record types SecureConn deals in, the same as the client and the
+// server number them.
+const (
+	recordError       byte = 4
+	recordClientMsg   byte = 5
+	recordServerMsg   byte = 6
+	recordClientClose byte = 7
+	recordServerClose byte = 8
+	recordServerAck   byte = 9
+)
+
+// ErrTruncated is returned by SecureConn.Read when the connection ends
+// without the server's close notify. Whoever cut it may have done so to drop
+// what the server sent next, the data read so far may be incomplete.
+var ErrTruncated = errors.New("session truncated: the connection ended without a close notify")
+
+// ErrCloseTimeout is returned by SecureConn.Close when the server did not
+// answer our close within the CloseTimeout. The connection is closed anyway.
+var ErrCloseTimeout = errors.New("close timed out: the server did not confirm the close")
+
+// PeerError is an ERROR the server sent in the session. The session may go
+// on after it, the server only rejected one message for instance.
+type PeerError struct {
+	Code byte
+	Text string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("server sent error %d: %s", e.Code, e.Text)
+}
+
+// SecureConn turns the client end of an established session into a plain
+// net.Conn. Writes are cut into CLIENT_MSG records encrypted with the
+// session's suite, reads decrypt the SERVER_MSG records and hand out their
+// plaintext as one continuous stream. SERVER_ACK records are skipped.
+//
+// Read returns io.EOF only once the server closed the session with a
+// SERVER_CLOSE carrying its close notify, and ErrTruncated when the
+// connection ends without one.
+type SecureConn struct {
+	net.Conn
+	suite crypt.Suite
+	key   []byte
+	// pending is the plaintext of the last record read that Read did not
+	// return yet.
+	pending []byte
+	// closed is set once the server's close notify was read.
+	closed bool
+
+	// writeMu serializes the records written, Read answers a SERVER_CLOSE
+	// while Write may be running.
+	writeMu sync.Mutex
+	// closeSent is set once CLIENT_CLOSE went out.
+	closeSent bool
+
+	// CloseTimeout bounds how long Close waits for the server to answer our
+	// close with its own. Zero closes the connection without waiting.
+	CloseTimeout time.Duration
+}
+
+func NewSecureConn(conn net.Conn, suite crypt.Suite, key []byte) *SecureConn {
+	return &SecureConn{
+		Conn:  conn,
+		suite: suite,
+		key:   key,
+	}
+}
+
+func (c *SecureConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		msg, err := ReadRecord(c.Conn)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, ErrTruncated
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch msg.Header {
+		case recordServerMsg:
+			if len(msg.Body) == 0 {
+				continue
+			}
+			c.pending, err = c.suite.Decrypt(c.key, msg.Body)
+			if err != nil {
+				return 0, err
+			}
+		case recordServerAck:
+		case recordServerClose:
+			notify, err := c.suite.Decrypt(c.key, msg.Body)
+			if err != nil || !bytes.Equal(notify, CloseNotify(recordServerClose)) {
+				return 0, errors.New("received a server close the server did not send")
+			}
+			c.closed = true
+			// A close crossing ours needs no answer.
+			if err := c.CloseWrite(); err != nil {
+				return 0, err
+			}
+		case recordError:
+			code, text, _, err := ParseErrorBody(msg.Body)
+			if err != nil {
+				return 0, err
+			}
+			return 0, &PeerError{Code: code, Text: text}
+		default:
+			return 0, fmt.Errorf("unexpected record %d in the session", msg.Header)
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *SecureConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return 0, errors.New("write on a closed session")
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > MAX_SECURE_CHUNK_SIZE {
+			chunk = chunk[:MAX_SECURE_CHUNK_SIZE]
+		}
+		if IsCloseNotify(chunk) {
+			// The server refuses such a message, it goes in two.
+			chunk = chunk[:len(chunk)-1]
+		}
+		ciphertext, err := c.suite.Encrypt(c.key, chunk)
+		if err != nil {
+			return written, err
+		}
+		if err := WriteRecord(c.Conn, recordClientMsg, ciphertext); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// CloseWrite ends the session on our side with a CLIENT_CLOSE carrying our
+// close notify, the server answers it with its own SERVER_CLOSE. Reads go on
+// until that answer, writes fail.
+func (c *SecureConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	notify, err := c.suite.Encrypt(c.key, CloseNotify(recordClientClose))
+	if err != nil {
+		return err
+	}
+	return WriteRecord(c.Conn, recordClientClose, notify)
+}
+
+// Close sends CLIENT_CLOSE unless it was already sent and closes the
+// connection. With a CloseTimeout it first reads, and drops, what the server
+// still sends until its close notify, and returns ErrCloseTimeout if that
+// takes longer. It must not run alongside Read then.
+func (c *SecureConn) Close() error {
+	err := c.CloseWrite()
+	if err == nil && c.CloseTimeout > 0 {
+		err = c.awaitClose()
+	}
+	if closeErr := c.Conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *SecureConn) awaitClose() error {
+	if err := c.SetReadDeadline(time.Now().Add(c.CloseTimeout)); err != nil {
+		return err
+	}
+	b := make([]byte, MAX_SECURE_CHUNK_SIZE)
+	for {
+		_, err := c.Read(b)
+		var peerErr *PeerError
+		var netErr net.Error
+		switch {
+		case err == nil, errors.As(err, &peerErr):
+		case err == io.EOF:
+			return nil
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return ErrCloseTimeout
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+)
+
+var secureSuite = crypt.SUITE_AES_256_CBC_HMAC_SHA256
+
+// secureSession returns the client end of a session over a pipe, and the
+// server end for the test to play the server on.
+func secureSession(t *testing.T) (*SecureConn, net.Conn, []byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	key := bytes.Repeat([]byte{7}, 32)
+	return NewSecureConn(client, secureSuite, key), server, key
+}
+
+func encrypted(t *testing.T, key []byte, plaintext []byte) []byte {
+	t.Helper()
+	ciphertext, err := secureSuite.Encrypt(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func TestSecureConnClose(t *testing.T) {
+	conn, server, key := secureSession(t)
+	hello, notify := encrypted(t, key, []byte("hello")), encrypted(t, key, CloseNotify(recordServerClose))
+	answer := make(chan Message, 1)
+	go func() {
+		WriteRecord(server, recordServerAck, []byte{0, 0, 0, 0, 0, 0, 0, 1})
+		WriteRecord(server, recordServerMsg, hello)
+		WriteRecord(server, recordServerClose, notify)
+		msg, _ := ReadRecord(server)
+		answer <- msg
+	}()
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("ReadAll() = %q, %v, want hello and no error", data, err)
+	}
+	// The server's close is answered with ours.
+	msg := <-answer
+	if msg.Header != recordClientClose {
+		t.Fatalf("got record %d after the server close, want CLIENT_CLOSE", msg.Header)
+	}
+	if notify, err := secureSuite.Decrypt(key, msg.Body); err != nil || !bytes.Equal(notify, CloseNotify(recordClientClose)) {
+		t.Errorf("CLIENT_CLOSE carries %q, %v, want the close notify", notify, err)
+	}
+	if _, err := conn.Write([]byte("late")); err == nil {
+		t.Error("Write() after the close succeeded")
+	}
+}
+
+func TestSecureConnCloseWaits(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers bool
+		want    error
+	}{
+		{"server answers", true, nil},
+		{"server silent", false, ErrCloseTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, server, key := secureSession(t)
+			conn.CloseTimeout = 100 * time.Millisecond
+			late, notify := encrypted(t, key, []byte("late")), encrypted(t, key, CloseNotify(recordServerClose))
+			closed := make(chan error, 1)
+			go func() {
+				if msg, err := ReadRecord(server); err != nil || msg.Header != recordClientClose {
+					closed <- fmt.Errorf("read record %d, %v, want CLIENT_CLOSE", msg.Header, err)
+					return
+				}
+				if tt.answers {
+					WriteRecord(server, recordServerMsg, late)
+					WriteRecord(server, recordServerClose, notify)
+				}
+				// Close closes the connection after waiting, or after giving up.
+				_, err := ReadRecord(server)
+				closed <- err
+			}()
+			if err := conn.Close(); err != tt.want {
+				t.Errorf("Close() = %v, want %v", err, tt.want)
+			}
+			if err := <-closed; !errors.Is(err, io.EOF) {
+				t.Errorf("server read %v after Close, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestSecureConnTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		cut  func(server net.Conn, hello []byte)
+	}{
+		{"between records", func(server net.Conn, hello []byte) {
+			WriteRecord(server, recordServerMsg, hello)
+		}},
+		{"inside a record", func(server net.Conn, hello []byte) {
+			data, _ := NewMessage(recordServerMsg, hello).MarshalBinary()
+			server.Write(data[:len(data)-1])
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, server, key := secureSession(t)
+			hello := encrypted(t, key, []byte("hello"))
+			go func() {
+				tt.cut(server, hello)
+				server.Close()
+			}()
+			if _, err := io.ReadAll(conn); !errors.Is(err, ErrTruncated) {
+				t.Errorf("ReadAll() = %v, want ErrTruncated", err)
+			}
+		})
+	}
+}
+
+func TestSecureConnForgedClose(t *testing.T) {
+	_, _, key := secureSession(t)
+	forged := [][]byte{
+		nil,
+		CloseNotify(recordServerClose),
+		encrypted(t, bytes.Repeat([]byte{8}, 32), CloseNotify(recordServerClose)),
+		// An earlier version of the notify, bound to no direction.
+		encrypted(t, key, []byte(CLOSE_NOTIFY)),
+		// Our own close, reflected back at us.
+		encrypted(t, key, CloseNotify(recordClientClose)),
+	}
+	for _, body := range forged {
+		conn, server, _ := secureSession(t)
+		go WriteRecord(server, recordServerClose, body)
+		if _, err := conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+			t.Errorf("Read() = %v after a SERVER_CLOSE of %q, want an error", err, body)
+		}
+	}
+}
+
+func TestSecureConnSplitsCloseNotify(t *testing.T) {
+	conn, server, key := secureSession(t)
+	notify := CloseNotify(recordServerClose)
+	go conn.Write(notify)
+	// A message the server would refuse goes out in two.
+	var got []byte
+	for len(got) < len(notify) {
+		msg, err := ReadRecord(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := secureSuite.Decrypt(key, msg.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsCloseNotify(plaintext) {
+			t.Fatalf("CLIENT_MSG carries the close notify %q", plaintext)
+		}
+		got = append(got, plaintext...)
+	}
+	if !bytes.Equal(got, notify) {
+		t.Errorf("server got %q, want %q", got, notify)
+	}
+}
+
+func TestSecureConnPeerError(t *testing.T) {
+	conn, server, key := secureSession(t)
+	still := encrypted(t, key, []byte("still here"))
+	go func() {
+		WriteRecord(server, recordError, ErrorBody(ERR_MESSAGE_TOO_LARGE, "too large", nil))
+		WriteRecord(server, recordServerMsg, still)
+	}()
+	var peerErr *PeerError
+	if _, err := conn.Read(make([]byte, 16)); !errors.As(err, &peerErr) || peerErr.Code != ERR_MESSAGE_TOO_LARGE {
+		t.Fatalf("Read() = %v, want a PeerError with ERR_MESSAGE_TOO_LARGE", err)
+	}
+	// The session goes on after it.
+	b := make([]byte, 16)
+	if n, err := conn.Read(b); err != nil || string(b[:n]) != "still here" {
+		t.Errorf("Read() = %q, %v after the error, want %q", b[:n], err, "still here")
+	}
+}
+
+func TestSecureConnWriteChunks(t *testing.T) {
+	conn, server, key := secureSession(t)
+	data := bytes.Repeat([]byte("x"), 2*MAX_SECURE_CHUNK_SIZE+1)
+	go conn.Write(data)
+	var got []byte
+	for len(got) < len(data) {
+		msg, err := ReadRecord(server)
+		if err != nil || msg.Header != recordClientMsg {
+			t.Fatalf("read record %d, %v, want CLIENT_MSG", msg.Header, err)
+		}
+		chunk, err := secureSuite.Decrypt(key, msg.Body)
+		if err != nil || len(chunk) > MAX_SECURE_CHUNK_SIZE {
+			t.Fatalf("chunk of %d bytes, %v", len(chunk), err)
+		}
+		got = append(got, chunk...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the chunks do not add up to what was written")
+	}
+}
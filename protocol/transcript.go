@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// Transcript accumulates the handshake records of a session, framing
+// included, exactly as they went over the wire and in that order. Both ends
+// feed it the records that make up the handshake, CLIENT_HELLO, SERVER_HELLO
+// and CLIENT_DONE, and SERVER_DONE carries its hash so that the client can
+// tell its handshake was not tampered with.
+type Transcript struct {
+	data []byte
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{}
+}
+
+// Add appends a record that was read.
+func (t *Transcript) Add(m Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	t.data = append(t.data, data...)
+	return nil
+}
+
+// WriteRecord writes a record as WriteRecord does, and appends it once it
+// was written.
+func (t *Transcript) WriteRecord(w io.Writer, recordType byte, payload []byte) error {
+	if err := WriteRecord(w, recordType, payload); err != nil {
+		return err
+	}
+	return t.Add(NewMessage(recordType, payload))
+}
+
+// Clone returns a copy of the transcript, for adding a record that may yet
+// be rejected.
+func (t *Transcript) Clone() *Transcript {
+	return &Transcript{data: append([]byte(nil), t.data...)}
+}
+
+// Bytes returns the records accumulated so far.
+func (t *Transcript) Bytes() []byte {
+	return t.data
+}
+
+// Sum returns the SHA-256 hash of the records accumulated so far.
+func (t *Transcript) Sum() []byte {
+	sum := sha256.Sum256(t.data)
+	return sum[:]
+}
@@ -0,0 +1,23 @@
+package main
+
+import "context"
+
+// MAX_CREDENTIAL_LEN is the most bytes a client credential may have.
+const MAX_CREDENTIAL_LEN = 256
+
+// Authenticator decides whether a client may open a session. It is given
+// the username and credential, such as a password, the client sent in
+// CLIENT_DONE, after both were decrypted under the session key. Anonymous
+// clients have an empty username, and clients sending no credential a nil
+// one. The rest of what is known about the connection is in the
+// SessionInfo of ctx, see SessionInfoFromContext.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, credential []byte) bool
+}
+
+// AllowAll is the default Authenticator, letting every client in.
+type AllowAll struct{}
+
+func (AllowAll) Authenticate(ctx context.Context, username string, credential []byte) bool {
+	return true
+}
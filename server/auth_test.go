@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// passwords accepts the users it knows with their password.
+type passwords map[string]string
+
+func (p passwords) Authenticate(ctx context.Context, username string, credential []byte) bool {
+	password, ok := p[username]
+	return ok && password == string(credential)
+}
+
+func TestAuthenticator(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		ok       bool
+	}{
+		{"good password", "bob:hunter2", true},
+		{"password with the delimiter", "alice:a:b", true},
+		{"bad password", "bob:hunter3", false},
+		{"no password", "bob", false},
+		{"unknown user", "eve:hunter2", false},
+		{"anonymous", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.Authenticator = passwords{"bob": "hunter2", "alice": "a:b"}
+			c := newTestClient(t, config)
+			c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+			reply := c.sendDone(tt.identity)
+			if tt.ok {
+				if reply.Header != SERVER_DONE {
+					t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+				}
+				return
+			}
+			if code, text := errorCode(t, reply); code != protocol.ERR_HANDSHAKE_FAILED {
+				t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+			}
+		})
+	}
+}
+
+func TestCredentialRefusedOnNullSuite(t *testing.T) {
+	config := testConfig()
+	config.AllowInsecure = true
+	c := newTestClient(t, config)
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_NULL)}})
+	if c.suite != crypt.SUITE_NULL {
+		t.Fatalf("negotiated %s, want NULL", c.suite)
+	}
+	if code, text := errorCode(t, c.sendDone("bob:hunter2")); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+	}
+	// Without a credential the insecure session is allowed.
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Errorf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+}
+
+// contextAuthenticator lets in the client whose context names the user it
+// expects, and records the SessionInfo it was given.
+type contextAuthenticator struct {
+	username string
+	info     SessionInfo
+	ok       bool
+}
+
+func (a *contextAuthenticator) Authenticate(ctx context.Context, username string, credential []byte) bool {
+	a.info, a.ok = SessionInfoFromContext(ctx)
+	return a.ok && a.info.Username == a.username
+}
+
+func TestAuthenticatorContext(t *testing.T) {
+	auth := &contextAuthenticator{username: "bob"}
+	config := testConfig()
+	config.Authenticator = auth
+	c := newTestClient(t, config)
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}, CorrelationID: []byte("abc")})
+
+	if code, _ := errorCode(t, c.sendDone("eve")); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("got error %d, want ERR_HANDSHAKE_FAILED", code)
+	}
+	if !auth.ok || auth.info.Username != "eve" {
+		t.Errorf("context of the rejected client = %+v, %v, want username eve", auth.info, auth.ok)
+	}
+
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+	info := auth.info
+	if info.Username != "bob" || info.Suite != suite || info.Version != protocol.VERSION || string(info.CorrelationID) != "abc" {
+		t.Errorf("context = %+v, want bob on %s, version %d, correlation abc", info, suite, protocol.VERSION)
+	}
+	if info.ServerFingerprint != c.pub.Fingerprint() {
+		t.Errorf("context fingerprint = %s, want %s", info.ServerFingerprint, c.pub.Fingerprint())
+	}
+	if info.HandshakeComplete {
+		t.Error("context reports the handshake complete before SERVER_DONE")
+	}
+}
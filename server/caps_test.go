@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestCapsAdvertiseNegotiableSuites(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*Config)
+		want   []crypt.Suite
+	}{
+		{"default", func(c *Config) {}, crypt.SupportedSuites()},
+		{"configured suites", func(c *Config) { c.Suites = []crypt.Suite{cfb} }, []crypt.Suite{cfb}},
+		{"security level", func(c *Config) { c.MinSecurityLevel = crypt.SECURITY_AUTHENTICATED }, []crypt.Suite{cbc}},
+		{"required suite", func(c *Config) { c.RequireSuite = cfb }, []crypt.Suite{cfb}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			tt.config(config)
+			c := newTestClient(t, config)
+			c.send(CLIENT_CAPS, nil)
+			reply := c.recv()
+			if reply.Header != SERVER_CAPS {
+				t.Fatalf("got record %d %q, want SERVER_CAPS", reply.Header, reply.Body)
+			}
+			var caps protocol.Caps
+			if err := caps.UnmarshalBinary(reply.Body); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(caps.Suites, suiteBytes(tt.want)) {
+				t.Errorf("advertised suites %v, want %v", caps.Suites, suiteBytes(tt.want))
+			}
+		})
+	}
+}
+
+func TestRequireSuite(t *testing.T) {
+	config := testConfig()
+	config.RequireSuite = cbc
+
+	c := newTestClient(t, config)
+	c.sendHello(protocol.ClientHello{Suites: suiteBytes([]crypt.Suite{cfb, cbc})})
+	if c.suite != cbc {
+		t.Errorf("negotiated %s, want %s", c.suite, cbc)
+	}
+
+	c = newTestClient(t, config)
+	body, _ := protocol.ClientHello{Suites: suiteBytes([]crypt.Suite{cfb})}.MarshalBinary()
+	c.send(CLIENT_HELLO, body)
+	if code, text := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// trackedConn counts the calls to Close of the transport it wraps.
+type trackedConn struct {
+	io.ReadWriteCloser
+	closes int
+}
+
+func (c *trackedConn) Close() error {
+	c.closes++
+	return c.ReadWriteCloser.Close()
+}
+
+func TestConnectionClosedOnError(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *testClient)
+	}{
+		{"peer EOF", func(c *testClient) {
+			c.conn.Close()
+		}},
+		{"duplicate hello", func(c *testClient) {
+			c.sendHello(protocol.ClientHello{})
+			c.send(CLIENT_HELLO, nil)
+			c.recv()
+		}},
+		{"oversize record", func(c *testClient) {
+			header := []byte{CLIENT_MSG, protocol.VERSION, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(header[2:], protocol.MAX_RECORD_SIZE+1)
+			if _, err := c.conn.Write(header); err != nil {
+				c.t.Fatal(err)
+			}
+			c.recv()
+		}},
+		{"too many handshake messages", func(c *testClient) {
+			for i := 0; i <= c.state.config.MaxHandshakeMessages; i++ {
+				c.send(CLIENT_DONE, nil)
+				c.recv()
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientRead, serverWrite := io.Pipe()
+			serverRead, clientWrite := io.Pipe()
+			server := &trackedConn{ReadWriteCloser: pipeTransport{serverRead, serverWrite}}
+			c := startTestClient(t, testConfig(), pipeEnd{clientRead, clientWrite}, server)
+			tt.run(c)
+			<-c.done
+			if server.closes != 1 {
+				t.Errorf("transport closed %d times, want once", server.closes)
+			}
+		})
+	}
+}
+
+// encrypt encrypts plaintext under the session key.
+func (c *testClient) encrypt(plaintext []byte) []byte {
+	c.t.Helper()
+	return encryptUnder(c.t, c.suite, c.key, plaintext)
+}
+
+// sendClose closes the session with a CLIENT_CLOSE carrying our notify, and
+// checks that the server answers with its own.
+func (c *testClient) sendClose() {
+	c.t.Helper()
+	c.send(CLIENT_CLOSE, c.encrypt(protocol.CloseNotify(CLIENT_CLOSE)))
+	reply := c.recv()
+	if reply.Header != SERVER_CLOSE {
+		c.t.Fatalf("got record %d %q, want SERVER_CLOSE", reply.Header, reply.Body)
+	}
+	notify, err := c.suite.Decrypt(c.key, reply.Body)
+	if err != nil || !bytes.Equal(notify, protocol.CloseNotify(SERVER_CLOSE)) {
+		c.t.Fatalf("SERVER_CLOSE carries %q, %v, want the close notify", notify, err)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	tests := []struct {
+		reason string
+		config func(config *Config)
+		run    func(c *testClient)
+	}{
+		{CLOSE_NORMAL, nil, func(c *testClient) {
+			c.handshake(suite, "bob")
+			c.sendClose()
+		}},
+		{CLOSE_HANDSHAKE_TIMEOUT, func(config *Config) {
+			config.HandshakeTimeout = 100 * time.Millisecond
+		}, func(c *testClient) {
+			c.recv()
+		}},
+		{CLOSE_PEER_EOF, nil, func(c *testClient) {
+			c.handshake(suite, "bob")
+			c.conn.Close()
+		}},
+		{CLOSE_READ_ERROR, nil, func(c *testClient) {
+			// The stream ends in the middle of a record.
+			c.conn.Write([]byte{CLIENT_HELLO, protocol.VERSION, 0})
+			c.conn.Close()
+		}},
+		{CLOSE_WRITE_ERROR, nil, func(c *testClient) {
+			// The client stops reading before the server answers.
+			c.conn.(pipeEnd).PipeReader.Close()
+			c.send(CLIENT_HELLO, nil)
+		}},
+		{CLOSE_PROTOCOL_ERROR, nil, func(c *testClient) {
+			c.sendHello(protocol.ClientHello{})
+			c.send(CLIENT_HELLO, nil)
+			c.recv()
+		}},
+		{CLOSE_CAPS_SENT, nil, func(c *testClient) {
+			c.send(CLIENT_CAPS, nil)
+			c.recv()
+		}},
+		{CLOSE_MESSAGE_LIMIT, func(config *Config) {
+			config.MaxMessagesPerSession = 1
+		}, func(c *testClient) {
+			c.handshake(suite, "bob")
+			c.sendMessage("last")
+			c.recv()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			config := testConfig()
+			if tt.config != nil {
+				tt.config(config)
+			}
+			var c *testClient
+			if config.HandshakeTimeout < time.Second {
+				c = newNetPipeClient(t, config)
+			} else {
+				c = newTestClient(t, config)
+			}
+			tt.run(c)
+			<-c.done
+			if info := c.state.ConnectionState(); info.CloseReason != tt.reason {
+				t.Errorf("close reason = %q, want %q", info.CloseReason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestSendCloseOnce(t *testing.T) {
+	state := NewConnState(1, testConfig())
+	var out bytes.Buffer
+	state.sendClose(&out)
+	state.sendClose(&out)
+	msg, err := protocol.ReadRecord(&out)
+	if err != nil || msg.Header != SERVER_CLOSE {
+		t.Fatalf("read %d, %v, want a SERVER_CLOSE", msg.Header, err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("sendClose() wrote %d more bytes after the first SERVER_CLOSE", out.Len())
+	}
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	config := testConfig()
+	config.MaxMessagesPerSession = 1
+	c := newTestClient(t, config)
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	c.sendMessage("last")
+	// The server closes on reaching its limit while our CLIENT_CLOSE is on
+	// its way, neither side waits for the other.
+	notify := c.encrypt(protocol.CloseNotify(CLIENT_CLOSE))
+	written := make(chan error, 1)
+	go func() {
+		written <- protocol.WriteRecord(c.conn, CLIENT_CLOSE, notify)
+	}()
+	if msg := c.recv(); msg.Header != SERVER_CLOSE {
+		t.Fatalf("got record %d, want SERVER_CLOSE", msg.Header)
+	}
+	<-c.done
+	if msg, err := protocol.ReadRecord(c.conn); err != io.EOF {
+		t.Errorf("got record %d, %v after the SERVER_CLOSE, want EOF", msg.Header, err)
+	}
+	// Our CLIENT_CLOSE went unread, closing our end gives up on it.
+	c.conn.Close()
+	<-written
+	if info := c.state.ConnectionState(); info.CloseReason != CLOSE_MESSAGE_LIMIT {
+		t.Errorf("close reason = %q, want %q", info.CloseReason, CLOSE_MESSAGE_LIMIT)
+	}
+}
+
+func TestForgedClientClose(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	forged := map[string][]byte{
+		"bare":          nil,
+		"unencrypted":   protocol.CloseNotify(CLIENT_CLOSE),
+		"unbound":       c.encrypt([]byte(protocol.CLOSE_NOTIFY)),
+		"server notify": c.encrypt(protocol.CloseNotify(SERVER_CLOSE)),
+		"other key":     encryptUnder(t, c.suite, bytes.Repeat([]byte{8}, 32), protocol.CloseNotify(CLIENT_CLOSE)),
+	}
+	for name, body := range forged {
+		c.send(CLIENT_CLOSE, body)
+		if code, text := errorCode(t, c.recv()); code != protocol.ERR_DECRYPT_FAILED {
+			t.Errorf("%s CLIENT_CLOSE: got error %d %q, want ERR_DECRYPT_FAILED", name, code, text)
+		}
+	}
+	// None of them ended the session.
+	if reply := c.sendMessage("still here"); reply.Header != SERVER_MSG {
+		t.Fatalf("got record %d %q after the forged closes, want SERVER_MSG", reply.Header, reply.Body)
+	}
+	c.sendClose()
+	<-c.done
+	if c.state.closeReason != CLOSE_NORMAL {
+		t.Errorf("close reason = %q, want %q", c.state.closeReason, CLOSE_NORMAL)
+	}
+}
+
+func TestCloseNotifyMessageRefused(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	// Echoed, either would be a close notify to relabel.
+	for _, header := range []byte{CLIENT_CLOSE, SERVER_CLOSE} {
+		reply := c.sendMessage(string(protocol.CloseNotify(header)))
+		if code, text := errorCode(t, reply); code != protocol.ERR_UNEXPECTED_MESSAGE {
+			t.Errorf("message carrying the notify of %d: got error %d %q, want ERR_UNEXPECTED_MESSAGE", header, code, text)
+		}
+	}
+	// The notify alone is just text.
+	if reply := c.sendMessage(protocol.CLOSE_NOTIFY); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q for %q, want SERVER_MSG", reply.Header, reply.Body, protocol.CLOSE_NOTIFY)
+	}
+}
+
+func encryptUnder(t *testing.T, suite crypt.Suite, key, plaintext []byte) []byte {
+	t.Helper()
+	ciphertext, err := suite.Encrypt(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// Config holds the server settings operators may tune. Each setting can be
+// set in the config file read by LoadConfig, under the key named after its
+// environment variable ("min_version" for SAFECHAT_MIN_VERSION), and then
+// overridden through that environment variable.
+type Config struct {
+	// MinVersion is the oldest protocol version clients may speak
+	// (SAFECHAT_MIN_VERSION).
+	MinVersion byte
+	// MaxHandshakeMessages is how many messages a client may send before
+	// its handshake is complete (SAFECHAT_MAX_HANDSHAKE_MESSAGES).
+	MaxHandshakeMessages int
+	// HandshakeTimeout bounds the time between accepting a client and the
+	// client completing its handshake with CLIENT_DONE, zero meaning no
+	// bound (SAFECHAT_HANDSHAKE_TIMEOUT, e.g. "10s").
+	HandshakeTimeout time.Duration
+	// HandshakeRetries is how many more times the server attempts the
+	// handshake steps that can fail transiently, like generating its key
+	// pair, before failing the handshake (SAFECHAT_HANDSHAKE_RETRIES).
+	HandshakeRetries int
+	// KeepAlivePeriod is the idle time before the first TCP keepalive probe,
+	// zero disabling keepalives (SAFECHAT_KEEPALIVE_PERIOD, e.g. "30s").
+	// Go releases before 1.23 also use it as the interval between probes,
+	// later ones leave that at 15s.
+	KeepAlivePeriod time.Duration
+	// MaxAcceptBackoff caps the wait between accepts while they keep
+	// failing, on running out of file descriptors for instance
+	// (SAFECHAT_MAX_ACCEPT_BACKOFF, e.g. "1s").
+	MaxAcceptBackoff time.Duration
+	// Nagle re-enables Nagle's algorithm, which is disabled by default for
+	// lower latency (SAFECHAT_NAGLE).
+	Nagle bool
+	// MaxPlaintextSize caps the size of a decrypted CLIENT_MSG, in bytes
+	// (SAFECHAT_MAX_PLAINTEXT_SIZE).
+	MaxPlaintextSize int
+	// MaxMessagesPerSession is how many CLIENT_MSG a session may carry
+	// before the server closes it, so that no key protects too much
+	// traffic. Zero means no limit (SAFECHAT_MAX_MESSAGES_PER_SESSION).
+	MaxMessagesPerSession uint64
+	// RequireSuite, when not zero, is the only cipher suite clients may
+	// negotiate (SAFECHAT_REQUIRE_SUITE, e.g. "AES-256-CBC-HMAC-SHA256").
+	RequireSuite crypt.Suite
+	// Suites is the server's order of preference among the supported
+	// suites, most preferred first, nil meaning crypt.SupportedSuites.
+	// Suites left out are never negotiated (SAFECHAT_SUITES, a comma
+	// separated list such as "AES-256-CBC-HMAC-SHA256,AES-256-CFB").
+	Suites []crypt.Suite
+	// PreferClientSuites picks the first of the client's suites the server
+	// accepts, rather than the first of the server's the client offers
+	// (SAFECHAT_PREFER_CLIENT_SUITES).
+	PreferClientSuites bool
+	// MinSecurityLevel is the lowest crypt security level a negotiated
+	// suite may have, crypt.SECURITY_AUTHENTICATED ruling out AES-256-CFB
+	// (SAFECHAT_MIN_SECURITY_LEVEL). Zero admits every supported suite.
+	MinSecurityLevel int
+	// AllowInsecure lets clients that also allow it negotiate
+	// crypt.SUITE_NULL, which sends every message in the clear. It is meant
+	// for debugging the protocol only (SAFECHAT_ALLOW_INSECURE).
+	AllowInsecure bool
+	// StrictHandshake closes the connection of a client sending a CLIENT_MSG
+	// before its handshake is complete, rather than only rejecting the
+	// message (SAFECHAT_STRICT_HANDSHAKE).
+	StrictHandshake bool
+	// HideParticipants refuses CLIENT_LIST, so that clients cannot learn
+	// who else is connected (SAFECHAT_HIDE_PARTICIPANTS).
+	HideParticipants bool
+	// ServerName, when not empty, is advertised to clients in SERVER_HELLO,
+	// up to protocol.MAX_SERVER_NAME_SIZE bytes (SAFECHAT_SERVER_NAME).
+	ServerName string
+	// Rand is where every random value the server generates, ephemeral keys
+	// and IVs, comes from. A deterministic source makes handshakes
+	// reproducible. It cannot be set from the environment.
+	Rand io.Reader
+	// RandTimeout bounds how long generating a key pair may wait on Rand,
+	// for entropy sources that block, zero meaning no bound
+	// (SAFECHAT_RAND_TIMEOUT, e.g. "5s").
+	RandTimeout time.Duration
+	// Key is the server's long-term private key, presented to every client
+	// so that clients can pin its fingerprint. When nil, a key pair is
+	// generated for each handshake. SAFECHAT_KEY_FILE, "key_file" in the
+	// config file, names a file holding it as written by the -genkey flag.
+	// A long-term key gives no forward secrecy: whoever gets hold of it can
+	// decrypt every recorded session.
+	Key *crypt.PrivateKey
+	// Authenticator is asked to let every client in once its handshake is
+	// about to complete. It cannot be set from the environment.
+	Authenticator Authenticator
+	// Participants tracks the sessions CLIENT_LIST reports, those of every
+	// connection served with this Config. It cannot be set from the
+	// environment.
+	Participants *Participants
+	// ProxyProtocol expects every connection to start with a PROXY protocol
+	// header, as sent by load balancers, and reports the client address it
+	// carries instead of the balancer's (SAFECHAT_PROXY_PROTOCOL).
+	ProxyProtocol bool
+	// DebugAddr, when not empty, is the address the expvar counters are
+	// served on, under /debug/vars (SAFECHAT_DEBUG_ADDR, e.g.
+	// "localhost:6700").
+	DebugAddr string
+	// Debug dumps every message read and written in hexadecimal
+	// (SAFECHAT_DEBUG).
+	Debug bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MinVersion:            protocol.VERSION,
+		MaxHandshakeMessages:  8,
+		HandshakeTimeout:      10 * time.Second,
+		HandshakeRetries:      2,
+		KeepAlivePeriod:       30 * time.Second,
+		MaxAcceptBackoff:      time.Second,
+		Nagle:                 false,
+		MaxPlaintextSize:      4096,
+		MaxMessagesPerSession: 0,
+		RequireSuite:          0,
+		Suites:                nil,
+		PreferClientSuites:    false,
+		MinSecurityLevel:      0,
+		AllowInsecure:         false,
+		StrictHandshake:       false,
+		HideParticipants:      false,
+		ServerName:            "",
+		Rand:                  rand.Reader,
+		RandTimeout:           5 * time.Second,
+		Key:                   nil,
+		Authenticator:         AllowAll{},
+		Participants:          NewParticipants(),
+		ProxyProtocol:         false,
+		DebugAddr:             "",
+		Debug:                 false,
+	}
+}
+
+// fileConfig is the layout of the config file. Settings left out of the file
+// are nil and keep their default.
+type fileConfig struct {
+	MinVersion            *byte     `json:"min_version"`
+	MaxHandshakeMessages  *int      `json:"max_handshake_messages"`
+	HandshakeTimeout      *string   `json:"handshake_timeout"`
+	HandshakeRetries      *int      `json:"handshake_retries"`
+	KeepAlivePeriod       *string   `json:"keepalive_period"`
+	MaxAcceptBackoff      *string   `json:"max_accept_backoff"`
+	Nagle                 *bool     `json:"nagle"`
+	MaxPlaintextSize      *int      `json:"max_plaintext_size"`
+	MaxMessagesPerSession *uint64   `json:"max_messages_per_session"`
+	RequireSuite          *string   `json:"require_suite"`
+	Suites                *[]string `json:"suites"`
+	PreferClientSuites    *bool     `json:"prefer_client_suites"`
+	MinSecurityLevel      *int      `json:"min_security_level"`
+	AllowInsecure         *bool     `json:"allow_insecure"`
+	StrictHandshake       *bool     `json:"strict_handshake"`
+	HideParticipants      *bool     `json:"hide_participants"`
+	ServerName            *string   `json:"server_name"`
+	RandTimeout           *string   `json:"rand_timeout"`
+	KeyFile               *string   `json:"key_file"`
+	ProxyProtocol         *bool     `json:"proxy_protocol"`
+	DebugAddr             *string   `json:"debug_addr"`
+	Debug                 *bool     `json:"debug"`
+}
+
+// LoadConfig returns the default settings, overridden by the JSON file at
+// path if path is not empty, and then by the environment.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return c, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return c, err
+	}
+	if c.MinVersion > protocol.VERSION {
+		return c, fmt.Errorf("invalid minimum version %d: newer than protocol version %d", c.MinVersion, protocol.VERSION)
+	}
+	// These would leave the server refusing every client rather than fail
+	// to start.
+	if c.MaxHandshakeMessages <= 0 {
+		return c, fmt.Errorf("invalid maximum number of handshake messages %d: must be positive", c.MaxHandshakeMessages)
+	}
+	if c.MaxPlaintextSize <= 0 {
+		return c, fmt.Errorf("invalid maximum plaintext size %d: must be positive", c.MaxPlaintextSize)
+	}
+	if len(acceptableSuites(&c)) == 0 {
+		return c, fmt.Errorf("no configured cipher suite meets the minimum security level %d", c.MinSecurityLevel)
+	}
+	if len(c.ServerName) > protocol.MAX_SERVER_NAME_SIZE {
+		return c, fmt.Errorf("invalid server name: longer than %d bytes", protocol.MAX_SERVER_NAME_SIZE)
+	}
+	if c.RequireSuite != 0 && c.RequireSuite.SecurityLevel() < c.MinSecurityLevel {
+		return c, fmt.Errorf("required cipher suite %s is below the minimum security level %d", c.RequireSuite, c.MinSecurityLevel)
+	}
+	if c.RequireSuite != 0 && !containsSuite(acceptableSuites(&c), c.RequireSuite) {
+		return c, fmt.Errorf("required cipher suite %s is not among the configured suites", c.RequireSuite)
+	}
+	return c, nil
+}
+
+// loadFile overrides the settings present in the config file at path.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f fileConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// A misspelt setting would otherwise be silently ignored.
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&f); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	if f.MinVersion != nil {
+		c.MinVersion = *f.MinVersion
+	}
+	if f.MaxHandshakeMessages != nil {
+		c.MaxHandshakeMessages = *f.MaxHandshakeMessages
+	}
+	if f.HandshakeTimeout != nil {
+		d, err := time.ParseDuration(*f.HandshakeTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid handshake_timeout in %s: %w", path, err)
+		}
+		c.HandshakeTimeout = d
+	}
+	if f.HandshakeRetries != nil {
+		c.HandshakeRetries = *f.HandshakeRetries
+	}
+	if f.KeepAlivePeriod != nil {
+		d, err := time.ParseDuration(*f.KeepAlivePeriod)
+		if err != nil {
+			return fmt.Errorf("invalid keepalive_period in %s: %w", path, err)
+		}
+		c.KeepAlivePeriod = d
+	}
+	if f.MaxAcceptBackoff != nil {
+		d, err := time.ParseDuration(*f.MaxAcceptBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid max_accept_backoff in %s: %w", path, err)
+		}
+		c.MaxAcceptBackoff = d
+	}
+	if f.Nagle != nil {
+		c.Nagle = *f.Nagle
+	}
+	if f.MaxPlaintextSize != nil {
+		c.MaxPlaintextSize = *f.MaxPlaintextSize
+	}
+	if f.MaxMessagesPerSession != nil {
+		c.MaxMessagesPerSession = *f.MaxMessagesPerSession
+	}
+	if f.RequireSuite != nil {
+		suite, err := crypt.ParseSuite(*f.RequireSuite)
+		if err != nil {
+			return fmt.Errorf("invalid require_suite in %s: %w", path, err)
+		}
+		c.RequireSuite = suite
+	}
+	if f.Suites != nil {
+		suites, err := parseSuites(*f.Suites)
+		if err != nil {
+			return fmt.Errorf("invalid suites in %s: %w", path, err)
+		}
+		c.Suites = suites
+	}
+	if f.PreferClientSuites != nil {
+		c.PreferClientSuites = *f.PreferClientSuites
+	}
+	if f.MinSecurityLevel != nil {
+		c.MinSecurityLevel = *f.MinSecurityLevel
+	}
+	if f.AllowInsecure != nil {
+		c.AllowInsecure = *f.AllowInsecure
+	}
+	if f.StrictHandshake != nil {
+		c.StrictHandshake = *f.StrictHandshake
+	}
+	if f.HideParticipants != nil {
+		c.HideParticipants = *f.HideParticipants
+	}
+	if f.ServerName != nil {
+		c.ServerName = *f.ServerName
+	}
+	if f.RandTimeout != nil {
+		d, err := time.ParseDuration(*f.RandTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid rand_timeout in %s: %w", path, err)
+		}
+		c.RandTimeout = d
+	}
+	if f.KeyFile != nil {
+		key, err := readKeyFile(*f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid key_file in %s: %w", path, err)
+		}
+		c.Key = key
+	}
+	if f.ProxyProtocol != nil {
+		c.ProxyProtocol = *f.ProxyProtocol
+	}
+	if f.DebugAddr != nil {
+		c.DebugAddr = *f.DebugAddr
+	}
+	if f.Debug != nil {
+		c.Debug = *f.Debug
+	}
+	return nil
+}
+
+// loadEnv overrides the settings whose environment variable is set.
+func (c *Config) loadEnv() error {
+	if err := envByte("SAFECHAT_MIN_VERSION", &c.MinVersion); err != nil {
+		return err
+	}
+	if err := envInt("SAFECHAT_MAX_HANDSHAKE_MESSAGES", &c.MaxHandshakeMessages); err != nil {
+		return err
+	}
+	if err := envDuration("SAFECHAT_HANDSHAKE_TIMEOUT", &c.HandshakeTimeout); err != nil {
+		return err
+	}
+	if err := envInt("SAFECHAT_HANDSHAKE_RETRIES", &c.HandshakeRetries); err != nil {
+		return err
+	}
+	if err := envDuration("SAFECHAT_KEEPALIVE_PERIOD", &c.KeepAlivePeriod); err != nil {
+		return err
+	}
+	if err := envDuration("SAFECHAT_MAX_ACCEPT_BACKOFF", &c.MaxAcceptBackoff); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_NAGLE", &c.Nagle); err != nil {
+		return err
+	}
+	if err := envInt("SAFECHAT_MAX_PLAINTEXT_SIZE", &c.MaxPlaintextSize); err != nil {
+		return err
+	}
+	if err := envUint64("SAFECHAT_MAX_MESSAGES_PER_SESSION", &c.MaxMessagesPerSession); err != nil {
+		return err
+	}
+	if err := envSuite("SAFECHAT_REQUIRE_SUITE", &c.RequireSuite); err != nil {
+		return err
+	}
+	if err := envSuites("SAFECHAT_SUITES", &c.Suites); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_PREFER_CLIENT_SUITES", &c.PreferClientSuites); err != nil {
+		return err
+	}
+	if err := envInt("SAFECHAT_MIN_SECURITY_LEVEL", &c.MinSecurityLevel); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_ALLOW_INSECURE", &c.AllowInsecure); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_STRICT_HANDSHAKE", &c.StrictHandshake); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_HIDE_PARTICIPANTS", &c.HideParticipants); err != nil {
+		return err
+	}
+	if err := envString("SAFECHAT_SERVER_NAME", &c.ServerName); err != nil {
+		return err
+	}
+	if err := envDuration("SAFECHAT_RAND_TIMEOUT", &c.RandTimeout); err != nil {
+		return err
+	}
+	if err := envKeyFile("SAFECHAT_KEY_FILE", &c.Key); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_PROXY_PROTOCOL", &c.ProxyProtocol); err != nil {
+		return err
+	}
+	if err := envString("SAFECHAT_DEBUG_ADDR", &c.DebugAddr); err != nil {
+		return err
+	}
+	if err := envBool("SAFECHAT_DEBUG", &c.Debug); err != nil {
+		return err
+	}
+	return nil
+}
+
+func envByte(name string, dst *byte) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = byte(n)
+	return nil
+}
+
+func envInt(name string, dst *int) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envString(name string, dst *string) error {
+	if v, ok := os.LookupEnv(name); ok {
+		*dst = v
+	}
+	return nil
+}
+
+func envUint64(name string, dst *uint64) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envBool(name string, dst *bool) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = b
+	return nil
+}
+
+func envSuite(name string, dst *crypt.Suite) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	suite, err := crypt.ParseSuite(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = suite
+	return nil
+}
+
+func envDuration(name string, dst *time.Duration) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = d
+	return nil
+}
+
+func envSuites(name string, dst *[]crypt.Suite) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	suites, err := parseSuites(strings.Split(v, ","))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = suites
+	return nil
+}
+
+func envKeyFile(name string, dst **crypt.PrivateKey) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	key, err := readKeyFile(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = key
+	return nil
+}
+
+// readKeyFile reads a private key written by writeKeyFile.
+func readKeyFile(path string) (*crypt.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key crypt.PrivateKey
+	if err := key.Unmarshal(bytes.TrimSpace(data)); err != nil {
+		return nil, err
+	}
+	// The public half goes out in every hello, clients must be able to use
+	// it.
+	pub := key.Public()
+	if err := new(crypt.PublicKey).Unmarshal(pub.Marshal()); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// writeKeyFile generates a private key and writes it to a new file at path,
+// readable by its owner only. It returns the public half.
+func writeKeyFile(path string, random io.Reader) (crypt.PublicKey, error) {
+	pub, priv, err := crypt.GenerateKeyPairFrom(random)
+	if err != nil {
+		return pub, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return pub, err
+	}
+	if _, err := f.Write(append(priv.Marshal(), '\n')); err != nil {
+		f.Close()
+		return pub, err
+	}
+	return pub, f.Close()
+}
+
+// parseSuites returns the supported suites named by names, in order.
+func parseSuites(names []string) ([]crypt.Suite, error) {
+	suites := make([]crypt.Suite, 0, len(names))
+	for _, name := range names {
+		suite, err := crypt.ParseSuite(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+)
+
+// writeConfig writes contents to a config file for the test and returns its
+// path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"max_handshake_messages": 4,
+		"handshake_timeout": "3s",
+		"max_plaintext_size": 512,
+		"suites": ["AES-256-CBC-HMAC-SHA256"],
+		"server_name": "from the file"
+	}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxHandshakeMessages != 4 || config.HandshakeTimeout != 3*time.Second || config.MaxPlaintextSize != 512 || config.ServerName != "from the file" {
+		t.Errorf("LoadConfig() = %+v, want the settings of the file", config)
+	}
+	if len(config.Suites) != 1 || config.Suites[0] != crypt.SUITE_AES_256_CBC_HMAC_SHA256 {
+		t.Errorf("Suites = %v, want only AES-256-CBC-HMAC-SHA256", config.Suites)
+	}
+	// Settings the file leaves out keep their defaults.
+	if defaults := DefaultConfig(); config.KeepAlivePeriod != defaults.KeepAlivePeriod {
+		t.Errorf("KeepAlivePeriod = %v, want the default %v", config.KeepAlivePeriod, defaults.KeepAlivePeriod)
+	}
+
+	// The environment overrides the file.
+	t.Setenv("SAFECHAT_MAX_PLAINTEXT_SIZE", "2048")
+	t.Setenv("SAFECHAT_SERVER_NAME", "from the environment")
+	config, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxPlaintextSize != 2048 || config.ServerName != "from the environment" {
+		t.Errorf("MaxPlaintextSize = %d, ServerName = %q, want the environment's", config.MaxPlaintextSize, config.ServerName)
+	}
+	if config.MaxHandshakeMessages != 4 {
+		t.Errorf("MaxHandshakeMessages = %d, want the file's 4", config.MaxHandshakeMessages)
+	}
+}
+
+func TestLoadConfigBadFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"bad JSON", `{"max_plaintext_size": 512`},
+		{"not an object", `[1, 2]`},
+		{"wrong type", `{"max_plaintext_size": "512"}`},
+		{"unknown field", `{"max_plaintext_sise": 512}`},
+		{"bad duration", `{"handshake_timeout": "3 seconds"}`},
+		{"unknown suite", `{"suites": ["ROT13"]}`},
+	}
+	for _, tt := range tests {
+		if _, err := LoadConfig(writeConfig(t, tt.contents)); err == nil {
+			t.Errorf("%s: LoadConfig() accepted %s", tt.name, tt.contents)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadConfig() accepted a missing file")
+	}
+}
+
+func TestLoadConfigRejectsUnusableLimits(t *testing.T) {
+	tests := []struct {
+		contents string
+		want     string
+	}{
+		{`{"max_handshake_messages": 0}`, "handshake messages"},
+		{`{"max_handshake_messages": -1}`, "handshake messages"},
+		{`{"max_plaintext_size": 0}`, "plaintext size"},
+		{`{"max_plaintext_size": -5}`, "plaintext size"},
+		{`{"min_security_level": 3}`, "security level"},
+		{`{"min_security_level": 2, "suites": ["AES-256-CFB"]}`, "security level"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(writeConfig(t, tt.contents))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadConfig(%s) = %v, want an error about the %s", tt.contents, err, tt.want)
+		}
+	}
+	// The highest level any suite has is still fine.
+	if _, err := LoadConfig(writeConfig(t, `{"min_security_level": 2}`)); err != nil {
+		t.Errorf("LoadConfig() with the authenticated level = %v", err)
+	}
+
+	// The environment is checked the same.
+	t.Setenv("SAFECHAT_MAX_PLAINTEXT_SIZE", "0")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() accepted SAFECHAT_MAX_PLAINTEXT_SIZE=0")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	crypt "safechat/encryption"
+)
+
+// SessionInfo is the read-only view of a connection returned by
+// ConnState.ConnectionState, and that hooks such as the Authenticator get
+// through their context.
+type SessionInfo struct {
+	// ID numbers the connections the server accepted, from 1.
+	ID uint64
+	// RemoteAddr is the client's address, nil when the transport has none.
+	RemoteAddr net.Addr
+	// Version and Suite are the negotiated protocol version and cipher
+	// suite.
+	Version byte
+	Suite   crypt.Suite
+	// Username is the name the client was authenticated under, empty while
+	// the handshake is not complete and for anonymous clients. The
+	// Authenticator gets the name it is asked to authenticate.
+	Username string
+	// ServerFingerprint is that of the public key this server presented in
+	// its hello, empty before the hello. The client has no key of its own,
+	// Username identifies it.
+	ServerFingerprint string
+	// Metadata and CorrelationID are what the client attached to its hello.
+	Metadata      []byte
+	CorrelationID []byte
+	// HandshakeComplete is set once SERVER_DONE was sent.
+	HandshakeComplete bool
+	// Accepted is when the connection was accepted, and HandshakeDuration
+	// how long from then the handshake took to complete, zero while it is
+	// not.
+	Accepted          time.Time
+	HandshakeDuration time.Duration
+	// CloseReason says why the connection ended, one of the CLOSE_*
+	// reasons, empty while it is open.
+	CloseReason string
+}
+
+type sessionInfoKey struct{}
+
+// SessionInfoFromContext returns the SessionInfo carried by ctx, if any.
+func SessionInfoFromContext(ctx context.Context) (SessionInfo, bool) {
+	info, ok := ctx.Value(sessionInfoKey{}).(SessionInfo)
+	return info, ok
+}
+
+// ConnectionState returns what was negotiated on the connection so far.
+// The info is a copy, later changes to the connection are not reflected.
+func (state *ConnState) ConnectionState() SessionInfo {
+	info := SessionInfo{
+		ID:            state.id,
+		RemoteAddr:    state.getRemoteAddr(),
+		Version:       state.version,
+		Suite:         state.getSuite(),
+		Username:      state.username,
+		Metadata:      append([]byte(nil), state.getMetadata()...),
+		CorrelationID: append([]byte(nil), state.correlationID...),
+		Accepted:      state.accepted,
+		CloseReason:   state.closeReason,
+	}
+	if state.priv != nil {
+		pub := state.priv.Public()
+		info.ServerFingerprint = pub.Fingerprint()
+	}
+	if !state.handshakeDone.IsZero() {
+		info.HandshakeComplete = true
+		info.HandshakeDuration = state.handshakeDone.Sub(state.accepted)
+	}
+	return info
+}
+
+// ExportKeyingMaterial derives length bytes from the session key for label,
+// see crypt.ExportKeyingMaterial. The client of the session gets the same
+// bytes from the key it transported. It fails until the server accepted
+// CLIENT_DONE and holds the session key.
+func (state *ConnState) ExportKeyingMaterial(label string, length int) ([]byte, error) {
+	keys := state.getSessionKeys()
+	if keys == nil {
+		return nil, errors.New("cannot export keying material before the handshake is complete")
+	}
+	return crypt.ExportKeyingMaterial(keys.key(), label, length)
+}
+
+// authContext returns the context of the Authenticator: a context carrying
+// the connection's current ConnectionState, with the username being
+// authenticated, which the connection only takes on once the Authenticator
+// let the client in.
+func (state *ConnState) authContext(username string) context.Context {
+	info := state.ConnectionState()
+	info.Username = username
+	return context.WithValue(context.Background(), sessionInfoKey{}, info)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestConnectionStateAfterHandshake(t *testing.T) {
+	c := newNetPipeClient(t, testConfig())
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}, Metadata: []byte("build=42"), CorrelationID: []byte("abc")})
+	if info := c.state.ConnectionState(); info.HandshakeComplete || info.HandshakeDuration != 0 {
+		t.Errorf("ConnectionState() = %+v after the hello, want the handshake incomplete", info)
+	}
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+	// The server completes the handshake once SERVER_DONE is out, it has by
+	// the time it answers a message.
+	if reply := c.sendMessage("hello"); reply.Header != SERVER_MSG {
+		t.Fatalf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+
+	info := c.state.ConnectionState()
+	if info.ID != 1 || info.RemoteAddr == nil {
+		t.Errorf("ID = %d, RemoteAddr = %v, want connection 1 with an address", info.ID, info.RemoteAddr)
+	}
+	if info.Version != protocol.VERSION || info.Suite != suite {
+		t.Errorf("negotiated version %d and %s, want %d and %s", info.Version, info.Suite, protocol.VERSION, suite)
+	}
+	if info.Username != "bob" {
+		t.Errorf("Username = %q, want bob", info.Username)
+	}
+	if info.ServerFingerprint != c.pub.Fingerprint() {
+		t.Errorf("ServerFingerprint = %s, want that of the presented key %s", info.ServerFingerprint, c.pub.Fingerprint())
+	}
+	if string(info.Metadata) != "build=42" || string(info.CorrelationID) != "abc" {
+		t.Errorf("Metadata = %q, CorrelationID = %q, want build=42 and abc", info.Metadata, info.CorrelationID)
+	}
+	if !info.HandshakeComplete || info.HandshakeDuration <= 0 {
+		t.Errorf("HandshakeComplete = %v, HandshakeDuration = %v, want a completed handshake", info.HandshakeComplete, info.HandshakeDuration)
+	}
+	if info.Accepted.IsZero() || info.Accepted.After(time.Now()) {
+		t.Errorf("Accepted = %v", info.Accepted)
+	}
+	if info.CloseReason != "" {
+		t.Errorf("CloseReason = %q while the connection is open", info.CloseReason)
+	}
+}
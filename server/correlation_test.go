@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestCorrelationIDEchoed(t *testing.T) {
+	c := newTestClient(t, testConfig())
+
+	// Before the hello there is nothing to echo.
+	c.send(CLIENT_DONE, []byte("too early"))
+	if _, _, id, err := protocol.ParseErrorBody(c.recv().Body); err != nil || id != nil {
+		t.Errorf("ERROR before the hello echoed %q, %v, want none", id, err)
+	}
+
+	c.sendHello(protocol.ClientHello{
+		Suites:        []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)},
+		CorrelationID: []byte("abc"),
+	})
+	if string(c.hello.CorrelationID) != "abc" {
+		t.Errorf("SERVER_HELLO echoed %q, want %q", c.hello.CorrelationID, "abc")
+	}
+
+	c.send(CLIENT_DONE, []byte("not a key"))
+	msg := c.recv()
+	errorCode(t, msg)
+	if _, _, id, _ := protocol.ParseErrorBody(msg.Body); string(id) != "abc" {
+		t.Errorf("ERROR echoed %q, want %q", id, "abc")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	config := testConfig()
+	config.HandshakeTimeout = 200 * time.Millisecond
+	c := newNetPipeClient(t, config)
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+
+	// The client stalls instead of sending CLIENT_DONE.
+	start := time.Now()
+	if code, text := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+	}
+	if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+		t.Errorf("reading after the timeout: %v, want EOF", err)
+	}
+	<-c.done
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection dropped after %v, want about %v", elapsed, config.HandshakeTimeout)
+	}
+	if c.state.closeReason != CLOSE_HANDSHAKE_TIMEOUT {
+		t.Errorf("close reason = %q, want %q", c.state.closeReason, CLOSE_HANDSHAKE_TIMEOUT)
+	}
+}
+
+func TestHandshakeTimeoutSparesSessions(t *testing.T) {
+	config := testConfig()
+	// Long enough for the handshake to beat it, even under the race
+	// detector.
+	config.HandshakeTimeout = 3 * time.Second
+	start := time.Now()
+	c := newNetPipeClient(t, config)
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+
+	time.Sleep(time.Until(start.Add(config.HandshakeTimeout + 500*time.Millisecond)))
+	if reply := c.sendMessage("still there"); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// A CLIENT_DONE whose key does not decrypt and one whose username does not
+// must be answered alike.
+func TestDoneDecryptFailuresLookAlike(t *testing.T) {
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	tests := []struct {
+		name    string
+		payload func(c *testClient) string
+	}{
+		{"bad key", func(c *testClient) string {
+			return "not a key"
+		}},
+		{"bad key with a username", func(c *testClient) string {
+			return "not a key" + USERNAME_DELIM + "bob"
+		}},
+		{"bad username", func(c *testClient) string {
+			return c.pub.EncryptString(make([]byte, 32)) + USERNAME_DELIM + "bob"
+		}},
+		{"username under another key", func(c *testClient) string {
+			other := make([]byte, 32)
+			if _, err := rand.Read(other); err != nil {
+				t.Fatal(err)
+			}
+			encrypted, err := suite.Encrypt(other, []byte("bob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c.pub.EncryptString(make([]byte, 32)) + USERNAME_DELIM + string(encrypted)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, testConfig())
+			c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+			c.send(CLIENT_DONE, []byte(tt.payload(c)))
+			code, text := errorCode(t, c.recv())
+			if code != protocol.ERR_DECRYPT_FAILED || text != DONE_DECRYPT_FAILED {
+				t.Errorf("got error %d %q, want %d %q", code, text, protocol.ERR_DECRYPT_FAILED, DONE_DECRYPT_FAILED)
+			}
+		})
+	}
+}
+
+func TestDoneIsEncrypted(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+	reply := c.sendDone("bob-the-user")
+	if reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+	if bytes.Contains(c.record.Bytes(), []byte("bob-the-user")) {
+		t.Error("CLIENT_DONE carries the username in the clear")
+	}
+	if bytes.Contains(reply.Body, []byte(protocol.SERVER_FINISHED)) {
+		t.Error("SERVER_DONE carries its confirmation in the clear")
+	}
+	finished, err := c.suite.Decrypt(c.key, reply.Body)
+	if err != nil || !bytes.HasPrefix(finished, []byte(protocol.SERVER_FINISHED)) {
+		t.Errorf("SERVER_DONE decrypts to %q, %v", finished, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestEmptyBodies(t *testing.T) {
+	// reply is the record the server answers a bare header with, and code
+	// the error code when it is an ERROR.
+	tests := []struct {
+		header byte
+		reply  byte
+		code   byte
+	}{
+		// Clients predating suite negotiation send an empty hello.
+		{CLIENT_HELLO, SERVER_HELLO, 0},
+		{SERVER_HELLO, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{CLIENT_DONE, ERROR, protocol.ERR_MALFORMED_MESSAGE},
+		{SERVER_DONE, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{ERROR, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{CLIENT_MSG, ERROR, protocol.ERR_MALFORMED_MESSAGE},
+		{SERVER_MSG, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		// Before the handshake there is nothing to authenticate a close
+		// with.
+		{CLIENT_CLOSE, SERVER_CLOSE, 0},
+		{SERVER_CLOSE, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{SERVER_ACK, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{CLIENT_CAPS, SERVER_CAPS, 0},
+		{SERVER_CAPS, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{CLIENT_LIST, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{SERVER_LIST, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{SERVER_LIST + 1, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+		{255, ERROR, protocol.ERR_UNEXPECTED_MESSAGE},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.header), func(t *testing.T) {
+			c := newTestClient(t, testConfig())
+			c.send(tt.header, nil)
+			reply := c.recv()
+			if tt.reply != ERROR {
+				if reply.Header != tt.reply {
+					t.Errorf("got record %d %q, want record %d", reply.Header, reply.Body, tt.reply)
+				}
+				return
+			}
+			if code, text := errorCode(t, reply); code != tt.code {
+				t.Errorf("got error %d %q, want %d", code, text, tt.code)
+			}
+		})
+	}
+}
+
+func TestEmptyBodiesAfterHandshake(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	for _, header := range []byte{CLIENT_DONE, CLIENT_MSG} {
+		c.send(header, nil)
+		if code, text := errorCode(t, c.recv()); code != protocol.ERR_MALFORMED_MESSAGE {
+			t.Errorf("header %d: got error %d %q, want ERR_MALFORMED_MESSAGE", header, code, text)
+		}
+	}
+	// The session survives them.
+	if reply := c.sendMessage("hi"); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+}
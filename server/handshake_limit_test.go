@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestMaxHandshakeMessages(t *testing.T) {
+	config := testConfig()
+	config.MaxHandshakeMessages = 3
+	c := newTestClient(t, config)
+	for i := 0; i < config.MaxHandshakeMessages; i++ {
+		c.send(CLIENT_DONE, nil)
+		if code, text := errorCode(t, c.recv()); code != protocol.ERR_MALFORMED_MESSAGE {
+			t.Fatalf("message %d: got error %d %q, want ERR_MALFORMED_MESSAGE", i+1, code, text)
+		}
+	}
+	c.send(CLIENT_DONE, nil)
+	if code, text := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("message over the cap: got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+	}
+	if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+		t.Errorf("reading after the cap: %v, want EOF", err)
+	}
+	<-c.done
+	if c.state.closeReason != CLOSE_PROTOCOL_ERROR {
+		t.Errorf("close reason = %q, want %q", c.state.closeReason, CLOSE_PROTOCOL_ERROR)
+	}
+}
+
+func TestMaxHandshakeMessagesSparesSessions(t *testing.T) {
+	config := testConfig()
+	config.MaxHandshakeMessages = 2
+	c := newTestClient(t, config)
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	for i := 0; i < 2*config.MaxHandshakeMessages; i++ {
+		if reply := c.sendMessage("hi"); reply.Header != SERVER_MSG {
+			t.Fatalf("message %d: got record %d %q, want SERVER_MSG", i+1, reply.Header, reply.Body)
+		}
+	}
+}
+
+func TestHandshakeSizeLimits(t *testing.T) {
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	tests := []struct {
+		name   string
+		header byte
+		size   int
+		setup  func(c *testClient)
+	}{
+		{"hello", CLIENT_HELLO, MAX_HELLO_SIZE + 1, func(c *testClient) {}},
+		{"done", CLIENT_DONE, MAX_DONE_SIZE + 1, func(c *testClient) {
+			c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, testConfig())
+			tt.setup(c)
+			c.send(tt.header, make([]byte, tt.size))
+			if code, text := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+				t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+			}
+			if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+				t.Errorf("reading after the oversize message: %v, want EOF", err)
+			}
+			<-c.done
+			if c.state.closeReason != CLOSE_PROTOCOL_ERROR {
+				t.Errorf("close reason = %q, want %q", c.state.closeReason, CLOSE_PROTOCOL_ERROR)
+			}
+		})
+	}
+
+	// A hello of exactly MAX_HELLO_SIZE bytes, padded with an extension the
+	// server does not know, goes through.
+	body, err := protocol.ClientHello{Suites: []byte{byte(suite)}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := MAX_HELLO_SIZE - len(body) - 3
+	body = append(body, 0xff, byte(padding>>8), byte(padding))
+	body = append(body, make([]byte, padding)...)
+	c := newTestClient(t, testConfig())
+	c.send(CLIENT_HELLO, body)
+	if reply := c.recv(); reply.Header != SERVER_HELLO {
+		t.Errorf("got record %d %q for a %d bytes hello, want SERVER_HELLO", reply.Header, reply.Body, len(body))
+	}
+}
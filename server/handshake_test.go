@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/internal/testutil"
+	"safechat/protocol"
+)
+
+// pipeTransport is one end of an in-memory connection.
+type pipeTransport struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// pipeEnd is the client's end of an in-memory connection. Closing it closes
+// both directions, so that the server's reads and writes fail alike.
+type pipeEnd struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeEnd) Close() error {
+	p.PipeWriter.Close()
+	return p.PipeReader.Close()
+}
+
+// testClient drives a session served by processClient.
+type testClient struct {
+	t      *testing.T
+	conn   io.ReadWriteCloser
+	state  *ConnState
+	done   <-chan struct{}
+	suite  crypt.Suite
+	pub    *crypt.PublicKey
+	key    []byte
+	hello  protocol.ServerHello
+	record *protocol.Transcript
+}
+
+// newTestClient serves a session over in-memory pipes, which have no
+// deadlines.
+func newTestClient(t *testing.T, config *Config) *testClient {
+	t.Helper()
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	return startTestClient(t, config, pipeEnd{clientRead, clientWrite}, pipeTransport{serverRead, serverWrite})
+}
+
+// newNetPipeClient serves a session over a net.Pipe, for tests that need the
+// server's read deadlines.
+func newNetPipeClient(t *testing.T, config *Config) *testClient {
+	t.Helper()
+	client, server := net.Pipe()
+	return startTestClient(t, config, client, server)
+}
+
+// startTestClient runs processClient on server, for a client talking over
+// client.
+func startTestClient(t *testing.T, config *Config, client, server io.ReadWriteCloser) *testClient {
+	t.Helper()
+	state := NewConnState(1, config)
+	c := &testClient{
+		t:      t,
+		conn:   client,
+		state:  &state,
+		record: protocol.NewTranscript(),
+	}
+	c.done = testutil.ServeConn(server, func(conn io.ReadWriteCloser) {
+		processClient(conn, c.state)
+	})
+	t.Cleanup(func() {
+		c.conn.Close()
+		<-c.done
+	})
+	return c
+}
+
+func (c *testClient) send(recordType byte, body []byte) {
+	c.t.Helper()
+	if err := c.record.WriteRecord(c.conn, recordType, body); err != nil {
+		c.t.Fatalf("writing record %d: %v", recordType, err)
+	}
+}
+
+func (c *testClient) recv() protocol.Message {
+	c.t.Helper()
+	msg, err := protocol.ReadRecord(c.conn)
+	if err != nil {
+		c.t.Fatalf("reading record: %v", err)
+	}
+	return msg
+}
+
+// sendHello sends hello and reads the SERVER_HELLO.
+func (c *testClient) sendHello(hello protocol.ClientHello) {
+	c.t.Helper()
+	body, err := hello.MarshalBinary()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(CLIENT_HELLO, body)
+	reply := c.recv()
+	if reply.Header != SERVER_HELLO {
+		c.t.Fatalf("got record %d %q, want SERVER_HELLO", reply.Header, reply.Body)
+	}
+	c.record.Add(reply)
+	if err := c.hello.UnmarshalBinary(reply.Body); err != nil {
+		c.t.Fatal(err)
+	}
+	c.suite = crypt.Suite(c.hello.Suite)
+	c.pub = &crypt.PublicKey{}
+	if err := c.pub.Unmarshal(c.hello.PublicKey); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// sendDone sends a CLIENT_DONE transporting a fresh key, with identity,
+// "username[:credential]", unless it is empty, and returns the reply.
+func (c *testClient) sendDone(identity string) protocol.Message {
+	c.t.Helper()
+	c.key = make([]byte, 32)
+	if _, err := rand.Read(c.key); err != nil {
+		c.t.Fatal(err)
+	}
+	payload := c.pub.EncryptString(c.key)
+	if identity != "" {
+		encrypted, err := c.suite.Encrypt(c.key, []byte(identity))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		payload += USERNAME_DELIM + string(encrypted)
+	}
+	c.send(CLIENT_DONE, []byte(payload))
+	return c.recv()
+}
+
+// handshake runs a whole handshake offering suite, and fails the test unless
+// the server completes it.
+func (c *testClient) handshake(suite crypt.Suite, identity string) {
+	c.t.Helper()
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+	reply := c.sendDone(identity)
+	if reply.Header != SERVER_DONE {
+		c.t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+}
+
+// errorCode returns the code of an ERROR record, failing the test for any
+// other record.
+func errorCode(t *testing.T, msg protocol.Message) (byte, string) {
+	t.Helper()
+	if msg.Header != ERROR {
+		t.Fatalf("got record %d, want ERROR", msg.Header)
+	}
+	code, text, _, err := protocol.ParseErrorBody(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, text
+}
+
+func testConfig() *Config {
+	config := DefaultConfig()
+	return &config
+}
+
+// BenchmarkHandshake measures the work of a handshake on both ends: the
+// server's key pair, signing and checking the challenge, transporting the
+// key and the finished message. processClient also waits a second before
+// SERVER_DONE, which would be all a benchmark through it measured.
+func BenchmarkHandshake(b *testing.B) {
+	config := testConfig()
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	challenge := make([]byte, protocol.CHALLENGE_SIZE)
+	key := make([]byte, 32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pub, priv, err := serverKeyPair(config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		marshalled := pub.Marshal()
+		signature := protocol.SignChallenge(&priv, challenge, marshalled)
+		if err := protocol.VerifyChallenge(&pub, challenge, signature); err != nil {
+			b.Fatal(err)
+		}
+		transported, err := priv.DecryptKey(pub.EncryptString(key), len(key))
+		if err != nil {
+			b.Fatal(err)
+		}
+		finished, err := suite.Encrypt(transported, []byte(protocol.SERVER_FINISHED))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := suite.Decrypt(key, finished); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestDuplicateClientHello(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *testClient)
+	}{
+		{"mid-handshake", func(c *testClient) {
+			c.sendHello(protocol.ClientHello{})
+		}},
+		{"established", func(c *testClient) {
+			c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, testConfig())
+			tt.setup(c)
+			c.send(CLIENT_HELLO, nil)
+			if code, text := errorCode(t, c.recv()); code != protocol.ERR_UNEXPECTED_MESSAGE {
+				t.Errorf("got error %d %q, want ERR_UNEXPECTED_MESSAGE", code, text)
+			}
+			if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+				t.Errorf("reading after the second hello: %v, want EOF", err)
+			}
+			<-c.done
+			if c.state.closeReason != CLOSE_PROTOCOL_ERROR {
+				t.Errorf("close reason = %q, want %q", c.state.closeReason, CLOSE_PROTOCOL_ERROR)
+			}
+		})
+	}
+}
+
+func TestHelloMetadata(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.sendHello(protocol.ClientHello{
+		Suites:   []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)},
+		Metadata: []byte("client/1.0 fr-FR"),
+	})
+	if got := string(c.state.getMetadata()); got != "client/1.0 fr-FR" {
+		t.Errorf("session metadata = %q, want %q", got, "client/1.0 fr-FR")
+	}
+}
+
+func TestHelloMetadataTooLarge(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	// MarshalBinary refuses oversize metadata, a client can still send it.
+	body, err := protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := protocol.MAX_METADATA_SIZE + 1
+	body = append(body, protocol.EXT_METADATA, byte(size>>8), byte(size))
+	body = append(body, make([]byte, size)...)
+	c.send(CLIENT_HELLO, body)
+	if code, text := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+	}
+	if got := c.state.getMetadata(); got != nil {
+		t.Errorf("session took %d bytes of oversize metadata", len(got))
+	}
+	// The rejected hello does not count as one.
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+}
+
+func TestNoRekey(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		config := testConfig()
+		config.StrictHandshake = strict
+		c := newTestClient(t, config)
+		c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+		key := c.key
+
+		// A CLIENT_DONE offering a new key, as a rekey would.
+		newKey := bytes.Repeat([]byte{0x5a}, 32)
+		c.send(CLIENT_DONE, []byte(c.pub.EncryptString(newKey)))
+		if code, text := errorCode(t, c.recv()); code != protocol.ERR_UNEXPECTED_MESSAGE {
+			t.Errorf("strict %v: rekey got error %d %q, want ERR_UNEXPECTED_MESSAGE", strict, code, text)
+		}
+
+		// The session goes on under the key it started with.
+		c.key = newKey
+		if code, text := errorCode(t, c.sendMessage("under the new key")); code != protocol.ERR_DECRYPT_FAILED {
+			t.Errorf("strict %v: message under the new key got error %d %q, want ERR_DECRYPT_FAILED", strict, code, text)
+		}
+		c.key = key
+		if reply := c.sendMessage("under the old key"); reply.Header != SERVER_MSG {
+			t.Errorf("strict %v: got record %d %q under the old key, want SERVER_MSG", strict, reply.Header, reply.Body)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	crypt "safechat/encryption"
+)
+
+// Handshakes running side by side, each on its own ConnState, must never
+// end up with one another's key pair or session key.
+func TestConcurrentSessionsAreIsolated(t *testing.T) {
+	const sessions = 8
+	type result struct {
+		pub        string
+		key        []byte
+		ciphertext []byte
+	}
+	var mu sync.Mutex
+	results := make(map[int]result)
+
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < sessions; i++ {
+			i := i
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				c := newTestClient(t, testConfig())
+				username := fmt.Sprintf("user%d", i)
+				c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, username)
+
+				plaintext := []byte(fmt.Sprintf("message of session %d", i))
+				ciphertext, err := c.suite.Encrypt(c.key, plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.send(CLIENT_MSG, ciphertext)
+				reply := c.recv()
+				if reply.Header != SERVER_MSG {
+					t.Fatalf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+				}
+				echoed, err := c.suite.Decrypt(c.key, reply.Body)
+				if err != nil || !bytes.Equal(echoed, plaintext) {
+					t.Fatalf("SERVER_MSG decrypts to %q, %v, want %q", echoed, err, plaintext)
+				}
+
+				// processClient is waiting for the next record.
+				if got := c.state.getUsername(); got != username {
+					t.Errorf("server session is %q, want %q", got, username)
+				}
+				if got := c.state.getSessionKeys().key(); !bytes.Equal(got, c.key) {
+					t.Errorf("server session key %x, want %x", got, c.key)
+				}
+
+				mu.Lock()
+				results[i] = result{c.pub.String(), c.key, ciphertext}
+				mu.Unlock()
+			})
+		}
+	})
+	if t.Failed() {
+		return
+	}
+
+	pubs := make(map[string]int)
+	for i, r := range results {
+		if j, ok := pubs[r.pub]; ok {
+			t.Errorf("sessions %d and %d got the same server key %s", i, j, r.pub)
+		}
+		pubs[r.pub] = i
+		for j, other := range results {
+			if i == j {
+				continue
+			}
+			if bytes.Equal(r.key, other.key) {
+				t.Errorf("sessions %d and %d share a session key", i, j)
+			}
+			if _, err := crypt.SUITE_AES_256_CBC_HMAC_SHA256.Decrypt(other.key, r.ciphertext); !errors.Is(err, crypt.ErrDecryptAuth) {
+				t.Errorf("message of session %d under the key of session %d: %v, want ErrDecryptAuth", i, j, err)
+			}
+		}
+	}
+}
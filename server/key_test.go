@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	crypt "safechat/encryption"
+)
+
+func TestServerKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+	pub, err := writeKeyFile(path, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := readKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.Key = key
+	// Every session presents the same key, so that clients can pin it.
+	for i := 0; i < 2; i++ {
+		c := newTestClient(t, config)
+		c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+		if got := c.pub.Fingerprint(); got != pub.Fingerprint() {
+			t.Errorf("session %d: server presented key %s, want %s", i, got, pub.Fingerprint())
+		}
+	}
+}
+
+func TestWriteKeyFileKeepsExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+	if _, err := writeKeyFile(path, rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(path)
+	if _, err := writeKeyFile(path, rand.Reader); err == nil {
+		t.Error("writeKeyFile() overwrote an existing key file")
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Error("writeKeyFile() changed an existing key file")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("key file mode = %v, want it readable by its owner only", mode)
+	}
+}
+
+func TestLoadConfigKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "server.key")
+	pub, err := writeKeyFile(keyPath, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"key_file": "`+keyPath+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("key_file: LoadConfig() = %v", err)
+	}
+	if !sameKey(config.Key, pub) {
+		t.Error("key_file: LoadConfig() did not load the key")
+	}
+
+	t.Setenv("SAFECHAT_KEY_FILE", keyPath)
+	config, err = LoadConfig("")
+	if err != nil {
+		t.Fatalf("SAFECHAT_KEY_FILE: LoadConfig() = %v", err)
+	}
+	if !sameKey(config.Key, pub) {
+		t.Error("SAFECHAT_KEY_FILE: LoadConfig() did not load the key")
+	}
+}
+
+func TestLoadConfigBadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"legacy", "3233,2753\n", "generated again"},
+		{"garbage", "not a key\n", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".key")
+		if err := os.WriteFile(path, []byte(tt.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("SAFECHAT_KEY_FILE", path)
+		_, err := LoadConfig("")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: LoadConfig() = %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+	t.Setenv("SAFECHAT_KEY_FILE", filepath.Join(dir, "missing.key"))
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() accepted a missing key file")
+	}
+}
+
+// sameKey reports whether key is the private half of pub.
+func sameKey(key *crypt.PrivateKey, pub crypt.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	got := key.Public()
+	return got.Fingerprint() == pub.Fingerprint()
+}
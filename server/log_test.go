@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// captureStdout returns what f printed, the server logging to the standard
+// output. Nothing else may be printing while f runs.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+// logLine returns the line of output starting with prefix.
+func logLine(t *testing.T, output, prefix string) string {
+	t.Helper()
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	t.Fatalf("no line starting with %q in:\n%s", prefix, output)
+	return ""
+}
+
+func TestHandshakeLog(t *testing.T) {
+	var c *testClient
+	output := captureStdout(t, func() {
+		c = newTestClient(t, testConfig())
+		c.sendHello(protocol.ClientHello{
+			Suites:        []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)},
+			CorrelationID: []byte("req-42"),
+		})
+		if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+			t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+		}
+		c.conn.Close()
+		<-c.done
+	})
+
+	line := logLine(t, output, "[handshake] ")
+	for _, field := range []string{
+		"id=1 ",
+		"remote=<nil> ",
+		fmt.Sprintf("version=%d ", protocol.VERSION),
+		"suite=AES-256-CBC-HMAC-SHA256 ",
+		"user=bob ",
+		"server_fingerprint=" + c.pub.Fingerprint() + " ",
+		`correlation="req-42" `,
+		"duration=",
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("handshake log %q lacks %q", line, field)
+		}
+	}
+}
@@ -2,14 +2,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"runtime/debug"
+	"strings"
 	"time"
 
 	crypt "safechat/encryption"
+	"safechat/protocol"
 )
 
 const (
@@ -28,20 +37,109 @@ const (
 	SERVER_MSG   byte = 6
 	CLIENT_CLOSE byte = 7
 	SERVER_CLOSE byte = 8
+	SERVER_ACK   byte = 9
+	CLIENT_CAPS  byte = 10
+	SERVER_CAPS  byte = 11
+	CLIENT_LIST  byte = 12
+	SERVER_LIST  byte = 13
+)
+
+const (
+	USERNAME_DELIM   = ":"
+	MAX_USERNAME_LEN = 32
+)
+
+// Handshake messages are small, these bounds are well above what an honest
+// client sends: a hello with every suite and extension, and a DONE with the
+// transported key and the longest username.
+const (
+	MAX_HELLO_SIZE = 1024
+	MAX_DONE_SIZE  = 2048
+)
+
+// DONE_DECRYPT_FAILED is the one description of a CLIENT_DONE that could
+// not be decrypted, whichever part of it failed.
+const DONE_DECRYPT_FAILED = "client done failed: could not be decrypted"
+
+// READ_BUFFER_SIZE is the size of the buffer client connections are read
+// through, room for a good many chat messages.
+const READ_BUFFER_SIZE = 16 * 1024
+
+// Reasons a connection gets closed for, reported when the client
+// disconnects.
+const (
+	CLOSE_NORMAL            = "normal close"
+	CLOSE_HANDSHAKE_TIMEOUT = "handshake timeout"
+	CLOSE_PEER_EOF          = "peer closed the connection"
+	CLOSE_READ_ERROR        = "read error"
+	CLOSE_WRITE_ERROR       = "write error"
+	CLOSE_PROTOCOL_ERROR    = "protocol error"
+	CLOSE_CAPS_SENT         = "capabilities sent"
+	CLOSE_INTERNAL_ERROR    = "internal error"
+	CLOSE_MESSAGE_LIMIT     = "session message limit reached"
 )
 
 // ConnState represents the state of the connection with the client.
 type ConnState struct {
+	id          uint64
+	config      *Config
 	clientHello bool
 	priv        *crypt.PrivateKey
-	sym         *[32]byte
+	keys        *SessionKeys
+	suite       crypt.Suite
+	version     byte
+	username    string
+	// acks is set when the client asked for a SERVER_ACK per message
+	// rather than an echo.
+	acks bool
+	// metadata is the opaque payload the client attached to its hello.
+	metadata []byte
+	// remoteAddr is the client's address: the one a PROXY protocol header
+	// reported, or else the peer of the transport, if it has one.
+	remoteAddr net.Addr
+	// transcript holds the handshake records exchanged so far, from the
+	// accepted CLIENT_HELLO on.
+	transcript *protocol.Transcript
+	// correlationID is the token the client attached to its hello, echoed
+	// back to it and printed along with the connection's logs.
+	correlationID []byte
+	// keepAlive is the keepalive period agreed in the hellos, zero when the
+	// client proposed none and the configured one applies.
+	keepAlive time.Duration
+	// handshakeMessages counts the messages received before the handshake
+	// completed.
+	handshakeMessages int
+	// closeSent is set once SERVER_CLOSE went out.
+	closeSent bool
+	// closeReason says why the connection ended, along with closeErr.
+	closeReason string
+	closeErr    error
+	// accepted is when the connection was accepted, and handshakeDone when
+	// its handshake completed.
+	accepted      time.Time
+	handshakeDone time.Time
+	// handshakeDeadline is the point in time by which the handshake must be
+	// complete, zero when it is not bounded.
+	handshakeDeadline time.Time
 }
 
-func NewConnState() ConnState {
+func NewConnState(id uint64, config *Config) ConnState {
+	var handshakeDeadline time.Time
+	if config.HandshakeTimeout > 0 {
+		handshakeDeadline = time.Now().Add(config.HandshakeTimeout)
+	}
 	return ConnState{
+		id:          id,
+		config:      config,
 		clientHello: false,
 		priv:        nil,
-		sym:         nil,
+		keys:        nil,
+		suite:       crypt.SUITE_AES_256_CFB,
+		version:     protocol.VERSION,
+		username:    "",
+
+		accepted:          time.Now(),
+		handshakeDeadline: handshakeDeadline,
 	}
 }
 
@@ -57,21 +155,133 @@ func (state *ConnState) getPrivKey() crypt.PrivateKey {
 	return *state.priv
 }
 
-func (state *ConnState) setSymKey(s [32]byte) error {
-	if state.sym != nil {
-		return errors.New("symmetric key was already set")
+func (state *ConnState) setSessionKeys(keys *SessionKeys) error {
+	if state.keys != nil {
+		return errors.New("session keys were already set")
 	}
-	state.sym = &s
+	state.keys = keys
 	return nil
 }
 
-func (state *ConnState) getSymKey() *[32]byte {
-	return state.sym
+func (state *ConnState) getSessionKeys() *SessionKeys {
+	return state.keys
+}
+
+func (state *ConnState) getMetadata() []byte {
+	return state.metadata
+}
+
+func (state *ConnState) getSuite() crypt.Suite {
+	return state.suite
+}
+
+// getRemoteAddr returns the address of the client, which is not the peer of
+// the connection when the server sits behind a load balancer.
+func (state *ConnState) getRemoteAddr() net.Addr {
+	return state.remoteAddr
+}
+
+// closeWith records why the connection is about to be closed and returns err so
+// that callers can write `return state.closeWith(reason, err)`. Only the first
+// reason is kept.
+func (state *ConnState) closeWith(reason string, err error) error {
+	if state.closeReason == "" {
+		state.closeReason = reason
+		state.closeErr = err
+	}
+	return err
+}
+
+// closeWithAlert is closeWith for fatal errors the client should hear
+// about: it first sends an ERROR with code and msg, on a best effort basis
+// since the connection may be what failed.
+func (state *ConnState) closeWithAlert(connection io.Writer, code byte, msg string, reason string, err error) error {
+	state.sendError(connection, code, msg)
+	return state.closeWith(reason, err)
+}
+
+// sendClose sends SERVER_CLOSE unless it was already sent, so that both
+// sides closing at once does not produce a second one.
+func (state *ConnState) sendClose(connection io.Writer) {
+	if state.closeSent {
+		return
+	}
+	state.closeSent = true
+	var notify []byte
+	if keys := state.getSessionKeys(); keys != nil {
+		var err error
+		notify, err = state.getSuite().EncryptFrom(state.config.Rand, keys.key(), protocol.CloseNotify(SERVER_CLOSE))
+		if err != nil {
+			fmt.Printf("[server log] could not encrypt close notify: %v\n", err)
+			return
+		}
+	}
+	protocol.WriteRecord(connection, SERVER_CLOSE, notify)
+}
+
+func (state *ConnState) handshakeComplete() bool {
+	return state.keys != nil
+}
+
+func (state *ConnState) setUsername(name string) error {
+	if state.username != "" {
+		return errors.New("username was already set")
+	}
+	if err := validateUsername(name); err != nil {
+		return err
+	}
+	state.username = name
+	return nil
+}
+
+// getUsername returns the name the client announced at handshake, or
+// "anonymous" if it did not send one.
+func (state *ConnState) getUsername() string {
+	if state.username == "" {
+		return "anonymous"
+	}
+	return state.username
+}
+
+// validateUsername accepts names of at most MAX_USERNAME_LEN characters made
+// of ASCII letters, digits, '_', '-' and '.'.
+func validateUsername(name string) error {
+	if len(name) == 0 {
+		return errors.New("username is empty")
+	}
+	if len(name) > MAX_USERNAME_LEN {
+		return fmt.Errorf("username is longer than %d characters", MAX_USERNAME_LEN)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '-', c == '.':
+		default:
+			return fmt.Errorf("username contains invalid character %q", c)
+		}
+	}
+	return nil
 }
 
 func run() error {
 	fmt.Println("Server Running...")
 
+	// SAFECHAT_CONFIG names the config file, if any.
+	config, err := LoadConfig(os.Getenv("SAFECHAT_CONFIG"))
+	if err != nil {
+		return err
+	}
+
+	if config.AllowInsecure {
+		fmt.Println("WARNING: insecure mode, clients allowing it will negotiate the NULL suite and send everything in the clear")
+	}
+
+	if config.DebugAddr != "" {
+		if err := serveDebug(config.DebugAddr); err != nil {
+			return err
+		}
+	}
+
 	server, err := net.Listen(SERVER_TYPE, SERVER_HOST+":"+SERVER_PORT)
 	if err != nil {
 		fmt.Println("Error listening:", err.Error())
@@ -81,19 +291,140 @@ func run() error {
 
 	fmt.Println("Listening on " + SERVER_HOST + ":" + SERVER_PORT)
 	fmt.Println("Waiting for client...")
+	return serve(server, &config)
+}
 
+// serve accepts clients on listener and processes them, until listener is
+// closed, which is not an error.
+func serve(listener net.Listener, config *Config) error {
+	connID := uint64(0)
+	// acceptDelay is how long to wait before accepting again after an
+	// error, zero once Accept succeeds.
+	var acceptDelay time.Duration
 	for {
-		connection, err := server.Accept()
-		state := NewConnState()
+		connection, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// The listener was closed to shut the server down.
+			return nil
+		}
 		if err != nil {
-			fmt.Println("Error accepting client: ", err.Error())
+			// Running out of file descriptors fails every Accept until a
+			// connection closes, and an error that never clears fails them
+			// all, do not spin on either.
+			acceptDelay = nextAcceptDelay(acceptDelay, config.MaxAcceptBackoff)
+			fmt.Printf("Error accepting client: %v, retrying in %v\n", err, acceptDelay)
+			time.Sleep(acceptDelay)
+			continue
+		}
+		acceptDelay = 0
+		if err := setKeepAlive(connection, config.KeepAlivePeriod); err != nil {
+			fmt.Println("Error enabling keepalive: ", err.Error())
+		}
+		if err := setNoDelay(connection, !config.Nagle); err != nil {
+			fmt.Println("Error setting TCP_NODELAY: ", err.Error())
+		}
+		if config.Debug {
+			connection = protocol.NewDumpConn(connection)
+		}
+		connID++
+		statConnections.Add(1)
+		state := NewConnState(connID, config)
+		if config.ProxyProtocol {
+			// The header counts towards the handshake, a balancer sends it
+			// right away.
+			connection.SetReadDeadline(state.handshakeDeadline)
+			addr, err := readProxyHeader(connection)
+			if err != nil {
+				fmt.Println("Error reading PROXY header: ", err.Error())
+				connection.Close()
+				continue
+			}
+			state.remoteAddr = addr
 		}
-		fmt.Println("client connected")
 		processClient(connection, &state)
 	}
 }
 
+// MIN_ACCEPT_BACKOFF is the wait after the first of a run of failed
+// accepts, doubled on each of the next ones.
+const MIN_ACCEPT_BACKOFF = 5 * time.Millisecond
+
+// nextAcceptDelay returns the wait following delay, capped at max.
+func nextAcceptDelay(delay, max time.Duration) time.Duration {
+	if delay == 0 {
+		delay = MIN_ACCEPT_BACKOFF
+	} else {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// MIN_KEEPALIVE_PERIOD is the shortest keepalive period a client can
+// negotiate, probing more often only costs the server.
+const MIN_KEEPALIVE_PERIOD = 5 * time.Second
+
+// negotiateKeepAlive settles the keepalive period of a session given the one
+// the client proposed and the one configured. The configured period is the
+// longest the server waits for a silent peer, clients can only ask to be
+// probed sooner, down to MIN_KEEPALIVE_PERIOD. Zero means nothing was
+// agreed: the client proposed nothing, or keepalives are disabled.
+func negotiateKeepAlive(proposed, configured time.Duration) time.Duration {
+	if proposed <= 0 || configured <= 0 {
+		return 0
+	}
+	if proposed < MIN_KEEPALIVE_PERIOD {
+		proposed = MIN_KEEPALIVE_PERIOD
+	}
+	if proposed > configured {
+		proposed = configured
+	}
+	return proposed
+}
+
+// setKeepAlive enables TCP keepalives on TCP connections so that peers that
+// vanished without closing are eventually noticed, or disables them when
+// period is zero.
+func setKeepAlive(connection io.ReadWriteCloser, period time.Duration) error {
+	tcp, ok := connection.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period <= 0 {
+		return tcp.SetKeepAlive(false)
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcp.SetKeepAlivePeriod(period)
+}
+
+// setNoDelay sets TCP_NODELAY on TCP connections. Chat messages are small
+// and each is answered, waiting for more data to coalesce them only adds
+// latency.
+func setNoDelay(connection net.Conn, noDelay bool) error {
+	tcp, ok := connection.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcp.SetNoDelay(noDelay)
+}
+
 func main() {
+	genkey := flag.String("genkey", "", "write a new long-term private key to this file for SAFECHAT_KEY_FILE, print its fingerprint and exit")
+	flag.Parse()
+	if *genkey != "" {
+		pub, err := writeKeyFile(*genkey, rand.Reader)
+		if err != nil {
+			fmt.Printf("An error occured: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s, clients can pin its fingerprint %s\n", *genkey, pub.Fingerprint())
+		return
+	}
+
 	// Running the code in a separate function allows executing the deferred
 	// functions before exiting with code 1. The call os.Exit() stops the
 	// subsequent deferred functions.
@@ -104,101 +435,627 @@ func main() {
 	}
 }
 
-func processClient(connection net.Conn, state *ConnState) {
+func processClient(connection io.ReadWriteCloser, state *ConnState) {
+	if state.remoteAddr == nil {
+		state.remoteAddr = remoteAddr(connection)
+	}
+	fmt.Printf("client connected: %s\n", state.getRemoteAddr())
 
 	defer func() {
-		fmt.Println("client disconnected")
+		// A bug triggered by one client must not bring the server, and
+		// every later client, down with it.
+		if r := recover(); r != nil {
+			fmt.Printf("[server log] panic while handling connection %d: %v\n%s", state.id, r, debug.Stack())
+			state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_INTERNAL_ERROR, fmt.Errorf("panic: %v", r))
+		}
+		state.config.Participants.leave(state)
+		connection.Close()
+		statCloses.Add(state.closeReason, 1)
+		fmt.Printf("client disconnected: %s (%v) correlation=%q\n", state.closeReason, state.closeErr, state.correlationID)
 	}()
 
+	// Records the client pipelined are all taken from the buffer before the
+	// connection is read again, rather than costing two reads each.
+	reader := bufio.NewReaderSize(connection, READ_BUFFER_SIZE)
 	for {
-		err := processMessage(connection, state)
+		err := processMessage(connection, reader, state)
+		var warning *recoverableError
+		if errors.As(err, &warning) {
+			fmt.Printf("[server log] %v\n", warning)
+			continue
+		}
 		if err != nil {
 			break
 		}
 	}
 }
 
-func processMessage(connection net.Conn, state *ConnState) error {
-	buffer := make([]byte, 1024*1024)
-	mLen, err := connection.Read(buffer)
+func processMessage(connection io.ReadWriteCloser, reader *bufio.Reader, state *ConnState) error {
+	// Only the handshake is bounded, an established session may stay quiet
+	// for as long as it likes.
+	if state.handshakeComplete() {
+		setReadDeadline(connection, time.Time{})
+	} else {
+		setReadDeadline(connection, state.handshakeDeadline)
+	}
+
+	msg, err := protocol.ReadRecord(reader)
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			fmt.Println("[server log] handshake timed out")
+			return state.closeWithAlert(connection, protocol.ERR_HANDSHAKE_FAILED, "handshake timed out", CLOSE_HANDSHAKE_TIMEOUT, err)
+		case errors.Is(err, io.EOF):
+			return state.closeWith(CLOSE_PEER_EOF, err)
+		case errors.Is(err, protocol.ErrRecordTooLarge):
+			// The body was not read, there is no finding the next record.
+			return state.closeWithAlert(connection, protocol.ERR_MESSAGE_TOO_LARGE, "received message larger than the record limit", CLOSE_PROTOCOL_ERROR, err)
+		default:
+			return state.closeWith(CLOSE_READ_ERROR, err)
+		}
 	}
-	if mLen == 0 {
-		return errors.New("Received null message")
+	if !state.handshakeComplete() {
+		state.handshakeMessages++
+		if state.handshakeMessages > state.config.MaxHandshakeMessages {
+			fmt.Println("[server log] too many handshake messages, closing connection")
+			return state.closeWithAlert(connection, protocol.ERR_HANDSHAKE_FAILED, "too many messages before the handshake completed", CLOSE_PROTOCOL_ERROR, errors.New("too many handshake messages"))
+		}
+	}
+
+	return handleMessage(connection, state, msg)
+}
+
+func handleMessage(connection io.ReadWriteCloser, state *ConnState, msg protocol.Message) error {
+	// The version is negotiated by CLIENT_HELLO, every later message must
+	// stick to it.
+	if msg.Header != CLIENT_HELLO && msg.Version != state.version {
+		state.sendError(connection, protocol.ERR_UNSUPPORTED_VERSION, "unsupported protocol version")
+		return recoverable(fmt.Errorf("received unsupported protocol version %d", msg.Version))
+	}
+	header := msg.Header
+	content := msg.Body
+
+	if len(content) == 0 && needsBody(header) {
+		state.sendError(connection, protocol.ERR_MALFORMED_MESSAGE, fmt.Sprintf("message %d needs a body", header))
+		return recoverable(fmt.Errorf("received message %d without a body", header))
+	}
+	// An oversized handshake message is no honest client's doing, there is
+	// no point in looking at it or in carrying on.
+	if limit, ok := handshakeSizeLimit(header); ok && len(content) > limit {
+		fmt.Printf("[server log] received a %d bytes handshake message %d, closing connection\n", len(content), header)
+		return state.closeWithAlert(connection, protocol.ERR_HANDSHAKE_FAILED, fmt.Sprintf("handshake message %d is limited to %d bytes", header, limit), CLOSE_PROTOCOL_ERROR, fmt.Errorf("handshake message %d too large", header))
 	}
-	header := buffer[0]
-	content := buffer[1:mLen]
 
 	switch header {
 	case CLIENT_HELLO:
 		fmt.Println("[client hello]: received client hello")
-		pub, priv := crypt.GenerateKeyPair()
-		err := state.setPrivKey(priv)
+		// A second hello would restart the handshake under the client's
+		// feet, there is no sane way to carry on.
+		if state.clientHello {
+			fmt.Println("[server log] received hello request twice, closing connection")
+			return state.closeWithAlert(connection, protocol.ERR_UNEXPECTED_MESSAGE, "client hello failed: received hello request twice", CLOSE_PROTOCOL_ERROR, errors.New("received hello request twice"))
+		}
+		var hello protocol.ClientHello
+		if err := hello.UnmarshalBinary(content); err != nil {
+			state.sendError(connection, protocol.ERR_MALFORMED_MESSAGE, "client hello failed: malformed hello")
+			return recoverable(err)
+		}
+		if len(hello.Metadata) > protocol.MAX_METADATA_SIZE {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, fmt.Sprintf("client hello failed: metadata larger than %d bytes", protocol.MAX_METADATA_SIZE))
+			return recoverable(fmt.Errorf("rejected %d bytes of metadata", len(hello.Metadata)))
+		}
+		if len(hello.CorrelationID) > protocol.MAX_CORRELATION_ID_SIZE {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, fmt.Sprintf("client hello failed: correlation id larger than %d bytes", protocol.MAX_CORRELATION_ID_SIZE))
+			return recoverable(fmt.Errorf("rejected a %d bytes correlation id", len(hello.CorrelationID)))
+		}
+		if hello.Challenge != nil && len(hello.Challenge) != protocol.CHALLENGE_SIZE {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, fmt.Sprintf("client hello failed: challenge must be %d bytes", protocol.CHALLENGE_SIZE))
+			return recoverable(fmt.Errorf("rejected a %d bytes challenge", len(hello.Challenge)))
+		}
+		version, err := negotiateVersion(msg.Version, state.config.MinVersion)
 		if err != nil {
-			connection.Write(writeMsg(ERROR, "client hello failed: received hello request twice"))
-			fmt.Println("[server log] received hello request twice")
-			break
+			state.sendError(connection, protocol.ERR_UNSUPPORTED_VERSION, "client hello failed: "+err.Error())
+			return recoverable(err)
+		}
+		suite, err := negotiateSuite(hello.Suites, state.config)
+		if err != nil {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client hello failed: "+err.Error())
+			return recoverable(err)
+		}
+		pub, priv, err := serverKeyPair(state.config)
+		if errors.Is(err, errRandTimeout) {
+			// The random source is stuck, another hello would only pile up
+			// behind it.
+			return state.closeWithAlert(connection, protocol.ERR_HANDSHAKE_FAILED, "client hello failed: handshake failed", CLOSE_INTERNAL_ERROR, err)
+		}
+		if err != nil {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client hello failed: handshake failed")
+			return recoverable(fmt.Errorf("could not generate a key pair: %w", err))
+		}
+		if err := state.setPrivKey(priv); err != nil {
+			return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+		}
+		state.clientHello = true
+		state.suite = suite
+		state.version = version
+		state.acks = hello.RequestAcks
+		state.metadata = hello.Metadata
+		state.correlationID = hello.CorrelationID
+		state.keepAlive = negotiateKeepAlive(hello.KeepAlive, state.config.KeepAlivePeriod)
+		if len(hello.Metadata) > 0 {
+			fmt.Printf("[client hello] client metadata: %q\n", hello.Metadata)
+		}
+		fmt.Printf("[client hello] negotiated cipher suite %s\n", suite)
+		if suite == crypt.SUITE_NULL {
+			fmt.Println("WARNING: this session is not encrypted, anyone on the path can read and alter it")
 		}
 
-		pubBytes := pub.Marshal()
-		sends := writeMsg(SERVER_HELLO, string(pubBytes))
+		serverHello := protocol.ServerHello{
+			Suite:         byte(suite),
+			PublicKey:     pub.Marshal(),
+			CorrelationID: state.correlationID,
+			ServerName:    state.config.ServerName,
+			KeepAlive:     state.keepAlive,
+		}
+		if hello.Challenge != nil {
+			serverHello.ChallengeSignature = protocol.SignChallenge(&priv, hello.Challenge, serverHello.PublicKey)
+		}
+		helloBytes, err := serverHello.MarshalBinary()
+		if err != nil {
+			return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+		}
+		if state.keepAlive != 0 {
+			if err := setKeepAlive(connection, state.keepAlive); err != nil {
+				fmt.Printf("[server log] could not apply the keepalive period: %v\n", err)
+			}
+			fmt.Printf("[client hello] keepalive period is %v\n", state.keepAlive)
+		}
+		state.transcript = protocol.NewTranscript()
+		if err := state.transcript.Add(msg); err != nil {
+			return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+		}
+		if err := state.transcript.WriteRecord(connection, SERVER_HELLO, helloBytes); err != nil {
+			fmt.Printf("[server log] could not send server hello: %v\n", err)
+			return state.closeWith(CLOSE_WRITE_ERROR, err)
+		}
 
-		connection.Write(sends)
+	case CLIENT_CAPS:
+		// Probing only makes sense instead of a handshake, not during one.
+		if state.clientHello {
+			state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "capabilities can only be requested before the handshake")
+			return recoverable(errors.New("received capabilities request during the handshake"))
+		}
+		fmt.Println("[client caps] received capabilities request")
+		caps := protocol.Caps{
+			MinVersion: state.config.MinVersion,
+			MaxVersion: protocol.VERSION,
+		}
+		// A required suite is the only one a handshake can end up with.
+		suites := acceptableSuites(state.config)
+		if state.config.RequireSuite != 0 {
+			suites = []crypt.Suite{state.config.RequireSuite}
+		}
+		for _, suite := range suites {
+			caps.Suites = append(caps.Suites, byte(suite))
+		}
+		capsBytes, err := caps.MarshalBinary()
+		if err != nil {
+			return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+		}
+		protocol.WriteRecord(connection, SERVER_CAPS, capsBytes)
+		return state.closeWith(CLOSE_CAPS_SENT, errors.New("client only wanted capabilities"))
 
 	case CLIENT_DONE:
+		// There is no key to decrypt with before the hello, and nothing left
+		// to agree on once the handshake is over.
+		if state.priv == nil || state.handshakeComplete() {
+			state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "client done failed: not expecting client done")
+			return recoverable(errors.New("received client done out of order"))
+		}
 		// At this step it is assumed that the client returned his symmetric
-		// key.
-		symKeyEncrypted := content
+		// key, optionally followed by its username, and then possibly its
+		// credential, encrypted under that key.
+		symKeyEncrypted, usernameEncrypted, hasUsername := strings.Cut(string(content), USERNAME_DELIM)
 		fmt.Printf("[client done] received encrypted symmetric key: %v\n", symKeyEncrypted)
 
 		privKey := state.getPrivKey()
-		symKey := privKey.DecryptString(fmt.Sprintf("%s", symKeyEncrypted))
+		symKey, err := privKey.DecryptKey(symKeyEncrypted, 32)
+		if err != nil {
+			// The same error whether the payload did not decode or did not
+			// decrypt, the client must not learn why the key was rejected.
+			state.sendError(connection, protocol.ERR_DECRYPT_FAILED, DONE_DECRYPT_FAILED)
+			return recoverable(fmt.Errorf("could not decrypt symmetric key: %w", err))
+		}
 		fmt.Printf("[client done] decrypted symmetrick key is: %v\n", symKey)
 
 		symKey32 := [32]byte{}
 		copy(symKey32[:], symKey[:])
 
-		state.setSymKey(symKey32)
+		var username string
+		var credential []byte
+		if hasUsername {
+			plaintext, err := state.getSuite().Decrypt(symKey32[:], []byte(usernameEncrypted))
+			if err != nil {
+				// Nor whether it was the key or the username that failed:
+				// a username that does not decrypt under a key that did
+				// would tell an attacker probing the key which guesses
+				// got through.
+				state.sendError(connection, protocol.ERR_DECRYPT_FAILED, DONE_DECRYPT_FAILED)
+				return recoverable(fmt.Errorf("could not decrypt username: %w", err))
+			}
+			// Usernames cannot contain the delimiter, whatever follows it is
+			// the credential.
+			name, secret, hasCredential := strings.Cut(string(plaintext), USERNAME_DELIM)
+			username = name
+			if hasCredential {
+				credential = []byte(secret)
+			}
+			if err := validateUsername(username); err != nil {
+				state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client done failed: "+err.Error())
+				return recoverable(fmt.Errorf("rejected username: %w", err))
+			}
+		}
+		if credential != nil && state.getSuite() == crypt.SUITE_NULL {
+			// It already went out in the clear, refusing it keeps clients
+			// from ever relying on that.
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client done failed: credentials are refused on the NULL suite")
+			return recoverable(errors.New("received a credential over the NULL suite"))
+		}
+		if len(credential) > MAX_CREDENTIAL_LEN {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client done failed: credential too long")
+			return recoverable(fmt.Errorf("credential is longer than %d bytes", MAX_CREDENTIAL_LEN))
+		}
+		if !state.config.Authenticator.Authenticate(state.authContext(username), username, credential) {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client done failed: authentication failed")
+			return recoverable(fmt.Errorf("authenticator rejected user %q", username))
+		}
+
+		// Only an accepted CLIENT_DONE belongs to the transcript.
+		transcript := state.transcript.Clone()
+		if err := transcript.Add(msg); err != nil {
+			return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+		}
+		var finished []byte
+		err = retry(state.config.HandshakeRetries, func() (err error) {
+			finished, err = state.getSuite().EncryptFrom(state.config.Rand, symKey32[:], append([]byte(protocol.SERVER_FINISHED), transcript.Sum()...))
+			return err
+		})
+		if err != nil {
+			state.sendError(connection, protocol.ERR_HANDSHAKE_FAILED, "client done failed: handshake failed")
+			return recoverable(fmt.Errorf("could not encrypt server finished: %w", err))
+		}
+
+		if hasUsername {
+			if err := state.setUsername(username); err != nil {
+				return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+			}
+		}
+		if err := state.setSessionKeys(NewSessionKeys(symKey32)); err != nil {
+			return state.closeWithAlert(connection, protocol.ERR_INTERNAL_ERROR, "internal error", CLOSE_PROTOCOL_ERROR, err)
+		}
+		state.transcript = transcript
+		fmt.Printf("[client done] client identified as %s\n", state.getUsername())
 
 		time.Sleep(1 * time.Second)
 
-		sends := writeMsg(SERVER_DONE, "")
-		connection.Write(sends)
+		if err := protocol.WriteRecord(connection, SERVER_DONE, finished); err != nil {
+			fmt.Printf("[server log] could not send server done: %v\n", err)
+			return state.closeWith(CLOSE_WRITE_ERROR, err)
+		}
+
+		state.handshakeDone = time.Now()
+		statHandshakes.Add(1)
+		state.config.Participants.join(state)
+		info := state.ConnectionState()
+		// The client has no key, it is identified by its username. The
+		// fingerprint is that of the key this server presented.
+		fmt.Printf("[handshake] id=%d remote=%v version=%d suite=%s user=%s server_fingerprint=%s correlation=%q duration=%v\n",
+			info.ID, info.RemoteAddr, info.Version, info.Suite, state.getUsername(), info.ServerFingerprint, info.CorrelationID, info.HandshakeDuration)
 
 	case CLIENT_MSG:
 		fmt.Printf("[message] received encrypted message: %s\n", base64.URLEncoding.EncodeToString(content))
-		symkey := state.getSymKey()
-		if symkey == nil {
-			fmt.Println("error: client tried to send message without encryption")
-			break
+		keys := state.getSessionKeys()
+		if keys == nil {
+			const text = "message failed: handshake is not complete"
+			err := errors.New("message before the handshake completed")
+			if state.config.StrictHandshake {
+				return state.closeWithAlert(connection, protocol.ERR_UNEXPECTED_MESSAGE, text, CLOSE_PROTOCOL_ERROR, err)
+			}
+			state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, text)
+			return recoverable(err)
 		}
-		if len(content) == 0 {
-			sends := []byte{ERROR}
-			sends = append(sends, []byte("there is no point in encrypting null messages")...)
-			connection.Write(sends)
-			break
+		recvSeq := keys.nextRecv()
+		msg, err := state.getSuite().Decrypt(keys.key(), content)
+		if err != nil {
+			state.sendError(connection, protocol.ERR_DECRYPT_FAILED, "message could not be decrypted")
+			return recoverable(fmt.Errorf("could not decrypt message: %w", err))
+		}
+		if len(msg) > state.config.MaxPlaintextSize {
+			state.sendError(connection, protocol.ERR_MESSAGE_TOO_LARGE, fmt.Sprintf("messages are limited to %d bytes", state.config.MaxPlaintextSize))
+			return recoverable(fmt.Errorf("rejected a %d bytes message", len(msg)))
 		}
-		msg := crypt.DecryptAES(symkey[:], content)
-		fmt.Printf("[message] decrypted message: %s\n", msg)
+		if protocol.IsCloseNotify(msg) {
+			// Echoed, it would be a close notify anyone on the path could
+			// relabel as one.
+			state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "message failed: messages may not carry a close notify")
+			return recoverable(errors.New("message carrying a close notify"))
+		}
+		fmt.Printf("[message] decrypted message from %s: %s\n", state.getUsername(), msg)
+		statMessages.Add(1)
 
-		sends := []byte{SERVER_MSG}
-		sends = append(sends, content...)
+		if state.acks {
+			seq := make([]byte, 8)
+			binary.BigEndian.PutUint64(seq, recvSeq)
+			protocol.WriteRecord(connection, SERVER_ACK, seq)
+		} else {
+			protocol.WriteRecord(connection, SERVER_MSG, content)
+		}
 
-		connection.Write(sends)
+		// The client reconnects for a fresh key rather than carrying on
+		// under this one.
+		if limit := state.config.MaxMessagesPerSession; limit > 0 && recvSeq >= limit {
+			fmt.Printf("[server log] session reached its limit of %d messages, closing connection\n", limit)
+			state.sendClose(connection)
+			return state.closeWith(CLOSE_MESSAGE_LIMIT, fmt.Errorf("%d messages", recvSeq))
+		}
+
+	case CLIENT_CLOSE:
+		// Either the client is closing, and gets our SERVER_CLOSE in reply, or
+		// it is answering a SERVER_CLOSE of ours. Both mean we are done.
+		// Once there is a session key the close must carry the client's
+		// notify, anyone on the path could inject a bare one and have us
+		// confirm a truncated session.
+		if keys := state.getSessionKeys(); keys != nil {
+			notify, err := state.getSuite().Decrypt(keys.key(), content)
+			if err != nil || !bytes.Equal(notify, protocol.CloseNotify(CLIENT_CLOSE)) {
+				state.sendError(connection, protocol.ERR_DECRYPT_FAILED, "close failed: close notify could not be verified")
+				return recoverable(errors.New("received a client close the client did not send"))
+			}
+		}
+		fmt.Println("[client close] client closed the session")
+		state.sendClose(connection)
+		return state.closeWith(CLOSE_NORMAL, errors.New("client closed the session"))
+
+	case CLIENT_LIST:
+		keys := state.getSessionKeys()
+		if keys == nil {
+			state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "list failed: handshake is not complete")
+			return recoverable(errors.New("participant list requested before the handshake completed"))
+		}
+		if state.config.HideParticipants {
+			state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "list failed: participants are not listed on this server")
+			return recoverable(errors.New("participant list requested while hidden"))
+		}
+		names := strings.Join(state.config.Participants.Usernames(), protocol.PARTICIPANT_DELIM)
+		list, err := state.getSuite().EncryptFrom(state.config.Rand, keys.key(), []byte(names))
+		if err != nil {
+			state.sendError(connection, protocol.ERR_INTERNAL_ERROR, "list failed: internal error")
+			return recoverable(fmt.Errorf("could not encrypt the participant list: %w", err))
+		}
+		protocol.WriteRecord(connection, SERVER_LIST, list)
+
+	case SERVER_HELLO, SERVER_DONE, SERVER_MSG, SERVER_CLOSE, SERVER_ACK, SERVER_CAPS, SERVER_LIST:
+		// Spoofed server messages are never valid input, whatever state the
+		// handshake is in.
+		state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "received server header from client")
+		return recoverable(fmt.Errorf("client sent server header %d", header))
 
 	default:
-		fmt.Printf("[error] received invalid header")
-		sends := writeMsg(ERROR, "received invalid header")
-		connection.Write(sends)
+		state.sendError(connection, protocol.ERR_UNEXPECTED_MESSAGE, "received invalid header")
+		return recoverable(fmt.Errorf("received invalid header %d", header))
 	}
 	return nil
 }
 
-func writeMsg(typ byte, msg string) []byte {
-	sends := []byte{typ}
-	if msg != "" {
-		sends = append(sends, []byte(msg)...)
+// recoverableError is a problem with a single message, which the client
+// was told about with an ERROR. processClient logs it and carries on with
+// the next message, where any other error ends the connection.
+type recoverableError struct {
+	err error
+}
+
+func recoverable(err error) error {
+	return &recoverableError{err: err}
+}
+
+func (e *recoverableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *recoverableError) Unwrap() error {
+	return e.err
+}
+
+// needsBody reports whether a client message is meaningless without a
+// body. CLIENT_HELLO may be empty, which is how clients predating suite
+// negotiation greet.
+func needsBody(header byte) bool {
+	switch header {
+	case CLIENT_DONE, CLIENT_MSG:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry runs op until it succeeds, at most retries times more after the first
+// attempt, and returns the last error. It is meant for the handshake steps
+// that may fail transiently, those reading from the random source.
+func retry(retries int, op func() error) error {
+	err := op()
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		fmt.Printf("[server log] retrying after failure: %v\n", err)
+		err = op()
+	}
+	return err
+}
+
+// errRandTimeout reports that the random source did not deliver in time.
+var errRandTimeout = errors.New("timed out waiting for the random source")
+
+// keyGeneration holds a token for as long as a key pair is being generated.
+// It is global rather than per connection because what it guards is the
+// random source, which the connections share: config.Rand, crypto/rand's
+// process-wide reader by default. When that source blocks, it blocks every
+// reader, and a per-connection token would let each new handshake leave one
+// more abandoned read behind. Serializing generations costs nothing else,
+// serve handles one connection at a time.
+var keyGeneration = make(chan struct{}, 1)
+
+// generateKeyPair generates the server's key pair for a handshake, retrying
+// transient failures, and gives up with errRandTimeout once RandTimeout has
+// passed. A read blocked on the random source cannot be interrupted: it
+// carries on in the background and its key pair is dropped. It keeps the
+// keyGeneration token until it returns, so there is never more than one
+// such read, and no other generation reads Rand alongside it: they wait for
+// the token within their own RandTimeout.
+func generateKeyPair(config *Config) (crypt.PublicKey, crypt.PrivateKey, error) {
+	var timeout <-chan time.Time
+	if config.RandTimeout > 0 {
+		timer := time.NewTimer(config.RandTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case keyGeneration <- struct{}{}:
+	case <-timeout:
+		return crypt.PublicKey{}, crypt.PrivateKey{}, errRandTimeout
+	}
+
+	type keyPair struct {
+		pub  crypt.PublicKey
+		priv crypt.PrivateKey
+		err  error
+	}
+	done := make(chan keyPair, 1)
+	go func() {
+		defer func() { <-keyGeneration }()
+		var k keyPair
+		k.err = retry(config.HandshakeRetries, func() (err error) {
+			k.pub, k.priv, err = crypt.GenerateKeyPairFrom(config.Rand)
+			return err
+		})
+		done <- k
+	}()
+
+	select {
+	case k := <-done:
+		return k.pub, k.priv, k.err
+	case <-timeout:
+		return crypt.PublicKey{}, crypt.PrivateKey{}, errRandTimeout
+	}
+}
+
+// serverKeyPair returns the server's long-term key pair if it has one, or
+// else generates one for the handshake.
+func serverKeyPair(config *Config) (crypt.PublicKey, crypt.PrivateKey, error) {
+	if config.Key != nil {
+		return config.Key.Public(), *config.Key, nil
+	}
+	return generateKeyPair(config)
+}
+
+// handshakeSizeLimit returns the largest body a handshake message may have,
+// ok being false for messages that are only bound by the record layer.
+func handshakeSizeLimit(header byte) (limit int, ok bool) {
+	switch header {
+	case CLIENT_HELLO:
+		return MAX_HELLO_SIZE, true
+	case CLIENT_DONE:
+		return MAX_DONE_SIZE, true
+	default:
+		return 0, false
+	}
+}
+
+// negotiateVersion picks the protocol version for the session given the
+// highest one the client speaks. Clients older than minVersion are refused
+// rather than downgraded to.
+func negotiateVersion(offered byte, minVersion byte) (byte, error) {
+	version := offered
+	if version > protocol.VERSION {
+		version = protocol.VERSION
+	}
+	if version < minVersion {
+		return 0, fmt.Errorf("protocol version %d is below the minimum version %d", offered, minVersion)
+	}
+	return version, nil
+}
+
+// negotiateSuite picks the cipher suite for the session from the ones the
+// client listed in its hello. The first suite of ours the client also offers
+// wins, or the first of the client's we accept when the configuration
+// prefers the client's order, unless the configuration requires a specific
+// suite. Clients that offer nothing predate negotiation and only know
+// AES-256-CFB. Suites below the configured security level are never picked.
+func negotiateSuite(offered []byte, config *Config) (crypt.Suite, error) {
+	if len(offered) == 0 {
+		offered = []byte{byte(crypt.SUITE_AES_256_CFB)}
 	}
-	return sends
+	acceptable := acceptableSuites(config)
+	if config.RequireSuite != 0 {
+		if !containsSuite(acceptable, config.RequireSuite) {
+			return 0, fmt.Errorf("required cipher suite %s is not acceptable", config.RequireSuite)
+		}
+		for _, b := range offered {
+			if crypt.Suite(b) == config.RequireSuite {
+				return config.RequireSuite, nil
+			}
+		}
+		return 0, fmt.Errorf("client does not offer the required cipher suite %s", config.RequireSuite)
+	}
+	if config.PreferClientSuites {
+		for _, b := range offered {
+			for _, suite := range acceptable {
+				if crypt.Suite(b) == suite {
+					return suite, nil
+				}
+			}
+		}
+	} else {
+		for _, suite := range acceptable {
+			for _, b := range offered {
+				if crypt.Suite(b) == suite {
+					return suite, nil
+				}
+			}
+		}
+	}
+	return 0, errors.New("no cipher suite in common")
+}
+
+// acceptableSuites lists the suites the configuration accepts at or above
+// its security level, most preferred first. When the configuration allows
+// insecure sessions the NULL suite comes first, so that it wins with every
+// client that offers it: those are debugging too.
+func acceptableSuites(config *Config) []crypt.Suite {
+	var suites []crypt.Suite
+	if config.AllowInsecure && crypt.SUITE_NULL.SecurityLevel() >= config.MinSecurityLevel {
+		suites = append(suites, crypt.SUITE_NULL)
+	}
+	preference := config.Suites
+	if preference == nil {
+		preference = crypt.SupportedSuites()
+	}
+	for _, suite := range preference {
+		if suite.SecurityLevel() >= config.MinSecurityLevel {
+			suites = append(suites, suite)
+		}
+	}
+	return suites
+}
+
+func containsSuite(suites []crypt.Suite, suite crypt.Suite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// sendError sends an ERROR with code and msg, tagged with the client's
+// correlation id once its hello set one.
+func (state *ConnState) sendError(connection io.Writer, code byte, msg string) error {
+	return protocol.WriteRecord(connection, ERROR, protocol.ErrorBody(code, msg, state.correlationID))
 }
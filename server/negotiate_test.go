@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+const (
+	cfb = crypt.SUITE_AES_256_CFB
+	cbc = crypt.SUITE_AES_256_CBC_HMAC_SHA256
+)
+
+func TestNegotiateSuite(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []crypt.Suite
+		config  func(*Config)
+		want    crypt.Suite
+	}{
+		{"server preference", []crypt.Suite{cfb, cbc}, func(c *Config) {}, cbc},
+		{"client preference", []crypt.Suite{cfb, cbc}, func(c *Config) { c.PreferClientSuites = true }, cfb},
+		{"server order", []crypt.Suite{cbc, cfb}, func(c *Config) { c.Suites = []crypt.Suite{cfb, cbc} }, cfb},
+		{"client order over server order", []crypt.Suite{cbc, cfb}, func(c *Config) {
+			c.Suites = []crypt.Suite{cfb, cbc}
+			c.PreferClientSuites = true
+		}, cbc},
+		{"suite left out", []crypt.Suite{cbc, cfb}, func(c *Config) {
+			c.Suites = []crypt.Suite{cfb}
+			c.PreferClientSuites = true
+		}, cfb},
+		{"legacy client", nil, func(c *Config) {}, cfb},
+		{"required suite", []crypt.Suite{cfb, cbc}, func(c *Config) { c.RequireSuite = cfb }, cfb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			tt.config(&config)
+			got, err := negotiateSuite(suiteBytes(tt.offered), &config)
+			if err != nil {
+				t.Fatalf("negotiateSuite() = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("negotiateSuite() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateSuiteRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []crypt.Suite
+		config  func(*Config)
+	}{
+		{"nothing in common", []crypt.Suite{cfb}, func(c *Config) { c.Suites = []crypt.Suite{cbc} }},
+		{"required suite not offered", []crypt.Suite{cfb}, func(c *Config) { c.RequireSuite = cbc }},
+		{"required suite left out", []crypt.Suite{cfb, cbc}, func(c *Config) {
+			c.Suites = []crypt.Suite{cfb}
+			c.RequireSuite = cbc
+		}},
+		{"unsupported suite", []crypt.Suite{99}, func(c *Config) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			tt.config(&config)
+			if got, err := negotiateSuite(suiteBytes(tt.offered), &config); err == nil {
+				t.Errorf("negotiateSuite() = %s, want an error", got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsRequiredSuiteLeftOut(t *testing.T) {
+	t.Setenv("SAFECHAT_SUITES", "AES-256-CFB")
+	t.Setenv("SAFECHAT_REQUIRE_SUITE", "AES-256-CBC-HMAC-SHA256")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() accepted a required suite left out of the suites")
+	}
+}
+
+func TestSecurityLevels(t *testing.T) {
+	null := crypt.SUITE_NULL
+	offered := suiteBytes([]crypt.Suite{null, cfb, cbc})
+	tests := []struct {
+		level         int
+		allowInsecure bool
+		acceptable    []crypt.Suite
+		// negotiated is what a client preferring the offered order gets,
+		// zero when the handshake fails.
+		negotiated crypt.Suite
+	}{
+		{0, false, []crypt.Suite{cbc, cfb}, cfb},
+		{0, true, []crypt.Suite{null, cbc, cfb}, null},
+		{crypt.SECURITY_CONFIDENTIAL, true, []crypt.Suite{cbc, cfb}, cfb},
+		{crypt.SECURITY_AUTHENTICATED, true, []crypt.Suite{cbc}, cbc},
+		{crypt.SECURITY_AUTHENTICATED + 1, true, nil, 0},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		config.MinSecurityLevel = tt.level
+		config.AllowInsecure = tt.allowInsecure
+		config.PreferClientSuites = true
+		if got := acceptableSuites(&config); !bytes.Equal(suiteBytes(got), suiteBytes(tt.acceptable)) {
+			t.Errorf("level %d, insecure %v: acceptableSuites() = %v, want %v", tt.level, tt.allowInsecure, got, tt.acceptable)
+		}
+		got, err := negotiateSuite(offered, &config)
+		switch {
+		case tt.negotiated == 0 && err == nil:
+			t.Errorf("level %d, insecure %v: negotiateSuite() = %s, want an error", tt.level, tt.allowInsecure, got)
+		case tt.negotiated != 0 && err != nil:
+			t.Errorf("level %d, insecure %v: negotiateSuite() = %v", tt.level, tt.allowInsecure, err)
+		case got != tt.negotiated && err == nil:
+			t.Errorf("level %d, insecure %v: negotiateSuite() = %s, want %s", tt.level, tt.allowInsecure, got, tt.negotiated)
+		}
+	}
+
+	// A suite below the level is refused even when it is all the client has.
+	config := DefaultConfig()
+	config.MinSecurityLevel = crypt.SECURITY_AUTHENTICATED
+	if got, err := negotiateSuite(suiteBytes([]crypt.Suite{cfb}), &config); err == nil {
+		t.Errorf("negotiateSuite() = %s below the security level, want an error", got)
+	}
+}
+
+func TestNullSuiteNeedsBothSides(t *testing.T) {
+	null := crypt.SUITE_NULL
+	tests := []struct {
+		name          string
+		allowInsecure bool
+		offered       []crypt.Suite
+		want          crypt.Suite
+	}{
+		{"both allow", true, []crypt.Suite{cbc, null}, null},
+		{"client only", false, []crypt.Suite{cbc, null}, cbc},
+		{"server only", true, []crypt.Suite{cbc, cfb}, cbc},
+		{"client only, nothing else offered", false, []crypt.Suite{null}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.AllowInsecure = tt.allowInsecure
+			c := newTestClient(t, config)
+			if tt.want != 0 {
+				c.sendHello(protocol.ClientHello{Suites: suiteBytes(tt.offered)})
+				if c.suite != tt.want {
+					t.Errorf("negotiated %s, want %s", c.suite, tt.want)
+				}
+				return
+			}
+			body, _ := protocol.ClientHello{Suites: suiteBytes(tt.offered)}.MarshalBinary()
+			c.send(CLIENT_HELLO, body)
+			if code, text := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+				t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsUnreachableSecurityLevel(t *testing.T) {
+	t.Setenv("SAFECHAT_MIN_SECURITY_LEVEL", "3")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() accepted a security level no suite meets")
+	}
+}
+
+func suiteBytes(suites []crypt.Suite) []byte {
+	var b []byte
+	for _, suite := range suites {
+		b = append(b, byte(suite))
+	}
+	return b
+}
+
+func TestNegotiateKeepAlive(t *testing.T) {
+	tests := []struct {
+		proposed, configured, want time.Duration
+	}{
+		{0, 30 * time.Second, 0},
+		{10 * time.Second, 0, 0},
+		{10 * time.Second, 30 * time.Second, 10 * time.Second},
+		{30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{time.Hour, 30 * time.Second, 30 * time.Second},
+		{time.Second, 30 * time.Second, MIN_KEEPALIVE_PERIOD},
+		{time.Second, 2 * time.Second, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := negotiateKeepAlive(tt.proposed, tt.configured); got != tt.want {
+			t.Errorf("negotiateKeepAlive(%v, %v) = %v, want %v", tt.proposed, tt.configured, got, tt.want)
+		}
+	}
+}
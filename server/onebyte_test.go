@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// allHeaders lists every record type, along with the first unassigned one
+// and the last possible one.
+var allHeaders = []byte{
+	CLIENT_HELLO, SERVER_HELLO, CLIENT_DONE, SERVER_DONE, ERROR, CLIENT_MSG, SERVER_MSG,
+	CLIENT_CLOSE, SERVER_CLOSE, SERVER_ACK, CLIENT_CAPS, SERVER_CAPS,
+	CLIENT_LIST, SERVER_LIST, SERVER_LIST + 1, 255,
+}
+
+func TestBareHeaderByte(t *testing.T) {
+	for _, header := range allHeaders {
+		c := newTestClient(t, testConfig())
+		if _, err := c.conn.Write([]byte{header}); err != nil {
+			t.Fatal(err)
+		}
+		c.conn.Close()
+		<-c.done
+		if info := c.state.ConnectionState(); info.CloseReason != CLOSE_READ_ERROR {
+			t.Errorf("header %d: close reason = %q, want %q", header, info.CloseReason, CLOSE_READ_ERROR)
+		}
+	}
+}
+
+// oneByteReply is what the server answers a one byte body with, code being
+// the error code of an ERROR.
+type oneByteReply struct {
+	header, code byte
+}
+
+var (
+	oneByteUnexpected = oneByteReply{ERROR, protocol.ERR_UNEXPECTED_MESSAGE}
+	oneByteMalformed  = oneByteReply{ERROR, protocol.ERR_MALFORMED_MESSAGE}
+	oneByteDecrypt    = oneByteReply{ERROR, protocol.ERR_DECRYPT_FAILED}
+)
+
+func TestOneByteBodies(t *testing.T) {
+	// The replies before the hello, between the hello and CLIENT_DONE, and
+	// once the handshake is complete. A client sends nothing but the records
+	// listed here, anything else is unexpected at every stage and
+	// TestServerHeadersRejected already covers it on established sessions.
+	// Once there is a session key, a close must carry the client's notify.
+	replies := map[byte][3]oneByteReply{
+		CLIENT_HELLO: {oneByteMalformed, oneByteUnexpected, oneByteUnexpected},
+		// Before the hello there is no key to decrypt CLIENT_DONE with.
+		CLIENT_DONE:  {oneByteUnexpected, oneByteDecrypt, oneByteUnexpected},
+		CLIENT_MSG:   {oneByteUnexpected, oneByteUnexpected, oneByteDecrypt},
+		CLIENT_CLOSE: {{SERVER_CLOSE, 0}, {SERVER_CLOSE, 0}, oneByteDecrypt},
+		CLIENT_CAPS:  {{SERVER_CAPS, 0}, oneByteUnexpected, oneByteUnexpected},
+		CLIENT_LIST:  {oneByteUnexpected, oneByteUnexpected, {SERVER_LIST, 0}},
+	}
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	stages := []struct {
+		name  string
+		setup func(c *testClient)
+	}{
+		{"new", func(c *testClient) {}},
+		{"hello", func(c *testClient) {
+			c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+		}},
+		{"established", func(c *testClient) {
+			c.handshake(suite, "bob")
+		}},
+	}
+	for _, header := range allHeaders {
+		want, ok := replies[header]
+		if !ok {
+			want = [3]oneByteReply{oneByteUnexpected, oneByteUnexpected, oneByteUnexpected}
+		}
+		for i, stage := range stages {
+			if !ok && stage.name == "established" {
+				continue
+			}
+			header, want, stage := header, want[i], stage
+			t.Run(fmt.Sprintf("%d/%s", header, stage.name), func(t *testing.T) {
+				t.Parallel()
+				c := newTestClient(t, testConfig())
+				stage.setup(c)
+				c.send(header, []byte{1})
+				msg := c.recv()
+				if msg.Header != want.header {
+					t.Fatalf("got record %d %q, want record %d", msg.Header, msg.Body, want.header)
+				}
+				if want.header != ERROR {
+					return
+				}
+				if code, text := errorCode(t, msg); code != want.code {
+					t.Errorf("got error %d %q, want %d", code, text, want.code)
+				}
+			})
+		}
+	}
+}
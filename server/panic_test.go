@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// panicking lets every client in but "boom", whose authentication panics.
+type panicking struct{}
+
+func (panicking) Authenticate(ctx context.Context, username string, credential []byte) bool {
+	if username == "boom" {
+		panic("authenticator bug")
+	}
+	return true
+}
+
+func TestHandlerPanic(t *testing.T) {
+	config := testConfig()
+	config.Authenticator = panicking{}
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+
+	c := newTestClient(t, config)
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+	if code, text := errorCode(t, c.sendDone("boom")); code != protocol.ERR_INTERNAL_ERROR {
+		t.Errorf("got error %d %q, want ERR_INTERNAL_ERROR", code, text)
+	}
+	if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+		t.Errorf("reading after the panic: %v, want EOF", err)
+	}
+	<-c.done
+	if c.state.closeReason != CLOSE_INTERNAL_ERROR {
+		t.Errorf("close reason = %q, want %q", c.state.closeReason, CLOSE_INTERNAL_ERROR)
+	}
+
+	// The panic only cost that one connection, the next client is served.
+	c = newTestClient(t, config)
+	c.handshake(suite, "bob")
+	if reply := c.sendMessage("still up"); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Participants is the set of sessions established on a server, with the
+// usernames CLIENT_LIST reports. Its methods are safe for concurrent use, and
+// do nothing on a nil *Participants.
+type Participants struct {
+	mu       sync.Mutex
+	sessions map[*ConnState]string
+}
+
+func NewParticipants() *Participants {
+	return &Participants{sessions: make(map[*ConnState]string)}
+}
+
+// join adds the session of state, once its handshake is complete.
+func (p *Participants) join(state *ConnState) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[state] = state.username
+}
+
+// leave removes the session of state, if it joined.
+func (p *Participants) leave(state *ConnState) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, state)
+}
+
+// Usernames returns the names of the sessions established, sorted, each
+// once however many sessions share it. Anonymous sessions are not listed.
+func (p *Participants) Usernames() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen := make(map[string]bool, len(p.sessions))
+	names := make([]string, 0, len(p.sessions))
+	for _, name := range p.sessions {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
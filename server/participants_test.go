@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// list asks the server for its participants.
+func (c *testClient) list() []string {
+	c.t.Helper()
+	c.send(CLIENT_LIST, nil)
+	reply := c.recv()
+	if reply.Header != SERVER_LIST {
+		c.t.Fatalf("got record %d %q, want SERVER_LIST", reply.Header, reply.Body)
+	}
+	names, err := c.suite.Decrypt(c.key, reply.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.Split(string(names), protocol.PARTICIPANT_DELIM)
+}
+
+func TestParticipants(t *testing.T) {
+	config := testConfig()
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	alice := newTestClient(t, config)
+	alice.handshake(suite, "alice")
+	bob := newTestClient(t, config)
+	bob.handshake(suite, "bob")
+	anonymous := newTestClient(t, config)
+	anonymous.handshake(suite, "")
+
+	for _, c := range []*testClient{alice, bob, anonymous} {
+		if names := c.list(); strings.Join(names, ",") != "alice,bob" {
+			t.Errorf("list = %q, want alice and bob", names)
+		}
+	}
+
+	// Sessions leave the list once closed.
+	bob.conn.Close()
+	<-bob.done
+	if names := alice.list(); strings.Join(names, ",") != "alice" {
+		t.Errorf("list = %q once bob left, want only alice", names)
+	}
+}
+
+func TestParticipantsRefused(t *testing.T) {
+	config := testConfig()
+	config.HideParticipants = true
+	c := newTestClient(t, config)
+	// There is no session key to encrypt a list with yet.
+	c.send(CLIENT_LIST, nil)
+	if code, text := errorCode(t, c.recv()); code != protocol.ERR_UNEXPECTED_MESSAGE {
+		t.Errorf("before the handshake: got error %d %q, want ERR_UNEXPECTED_MESSAGE", code, text)
+	}
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	c.send(CLIENT_LIST, nil)
+	if code, text := errorCode(t, c.recv()); code != protocol.ERR_UNEXPECTED_MESSAGE {
+		t.Errorf("hidden: got error %d %q, want ERR_UNEXPECTED_MESSAGE", code, text)
+	}
+	// The session goes on.
+	if reply := c.sendMessage("hi"); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+}
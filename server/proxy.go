@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY_V2_SIGNATURE starts every version 2 PROXY protocol header.
+var PROXY_V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// MAX_PROXY_V1_SIZE is the longest a version 1 header may be, CRLF included.
+const MAX_PROXY_V1_SIZE = 107
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2, that a
+// load balancer sends ahead of the client's own bytes, and returns the
+// address of the client it stands for. The address is nil when the header
+// does not carry one, such as health checks from the balancer itself.
+//
+// The header is read without reading past it, so that the connection can be
+// handed to the protocol as if the balancer was not there.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// Any header, even "PROXY UNKNOWN\r\n", is longer than the signature.
+	start := make([]byte, len(PROXY_V2_SIGNATURE))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, PROXY_V2_SIGNATURE) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(r, start)
+	}
+	return nil, errors.New("connection does not start with a PROXY protocol header")
+}
+
+func readProxyV1(r io.Reader, line []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= MAX_PROXY_V1_SIZE {
+			return nil, errors.New("PROXY header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	// PROXY TCP4 <source> <destination> <source port> <destination port>
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	// version and command (1 byte), family and transport (1 byte), length
+	// of the addresses (2 bytes, big endian)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[0]>>4)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are the balancer's own, PROXY ones relay a client.
+	// No other command is defined.
+	switch header[0] & 0x0f {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", header[0]&0x0f)
+	}
+	switch header[1] {
+	case 0x11: // TCP over IPv4
+		if len(addresses) < 12 {
+			return nil, errors.New("PROXY header truncated in its addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addresses) < 36 {
+			return nil, errors.New("PROXY header truncated in its addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
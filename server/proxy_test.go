@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a version 2 header with the given version and command
+// byte, family and transport byte, and addresses.
+func proxyV2(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, PROXY_V2_SIGNATURE...)
+	header = append(header, command, family, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{
+		192, 0, 2, 1, // source
+		198, 51, 100, 1, // destination
+		0x30, 0x39, // source port 12345
+		0x00, 0x50, // destination port 80
+	}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	ipv6[32], ipv6[33] = 0x30, 0x39
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string // empty for no address
+		ok     bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 80\r\n"), "192.0.2.1:12345", true},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"), "[2001:db8::1]:12345", true},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", true},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 12345 80\r\n"), "", true},
+		{"v1 udp", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 12345 80\r\n"), "", false},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2.300 198.51.100.1 12345 80\r\n"), "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 80\r\n"), "", false},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", MAX_PROXY_V1_SIZE) + "\r\n"), "", false},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51.100.1"), "", false},
+		{"v2 proxy tcp4", proxyV2(0x21, 0x11, ipv4), "192.0.2.1:12345", true},
+		{"v2 proxy tcp6", proxyV2(0x21, 0x21, ipv6), "[2001:db8::1]:12345", true},
+		{"v2 local", proxyV2(0x20, 0x11, ipv4), "", true},
+		{"v2 local without addresses", proxyV2(0x20, 0x00, nil), "", true},
+		{"v2 proxy unspecified family", proxyV2(0x21, 0x00, nil), "", true},
+		{"v2 command 2", proxyV2(0x22, 0x11, ipv4), "", false},
+		{"v2 command 15", proxyV2(0x2f, 0x11, ipv4), "", false},
+		{"v2 version 1", proxyV2(0x11, 0x11, ipv4), "", false},
+		{"v2 tcp4 short addresses", proxyV2(0x21, 0x11, ipv4[:8]), "", false},
+		{"v2 tcp6 short addresses", proxyV2(0x21, 0x21, ipv6[:20]), "", false},
+		{"v2 truncated header", proxyV2(0x21, 0x11, ipv4)[:len(PROXY_V2_SIGNATURE)+2], "", false},
+		{"v2 truncated addresses", proxyV2(0x21, 0x11, ipv4)[:len(PROXY_V2_SIGNATURE)+10], "", false},
+		{"truncated signature", PROXY_V2_SIGNATURE[:6], "", false},
+		{"no header", []byte("\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), "", false},
+	}
+	for _, tt := range tests {
+		// What follows the header belongs to the protocol and must be left
+		// unread.
+		r := bytes.NewReader(append(append([]byte{}, tt.header...), "rest"...))
+		addr, err := readProxyHeader(r)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: readProxyHeader() = %v, nil, want an error", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readProxyHeader() = %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.addr {
+			t.Errorf("%s: readProxyHeader() = %q, want %q", tt.name, got, tt.addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("%s: %q left after the header, want \"rest\"", tt.name, rest)
+		}
+	}
+}
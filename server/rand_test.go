@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// blockingReader blocks every read until release is closed, and then reads
+// from crypto/rand.
+type blockingReader struct {
+	release chan struct{}
+	reads   atomic.Int32
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	<-r.release
+	return rand.Read(p)
+}
+
+// seededReader is a deterministic stream: the SHA-256 of seed and a block
+// counter, block after block.
+type seededReader struct {
+	seed    byte
+	counter uint64
+	block   []byte
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.block) == 0 {
+			var input [9]byte
+			input[0] = r.seed
+			binary.BigEndian.PutUint64(input[1:], r.counter)
+			r.counter++
+			sum := sha256.Sum256(input[:])
+			r.block = sum[:]
+		}
+		copied := copy(p[n:], r.block)
+		r.block = r.block[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+func TestRandReproducible(t *testing.T) {
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	// handshake returns the key the server presents and the IV of its
+	// SERVER_DONE when drawing from seed.
+	handshake := func(seed byte) ([]byte, []byte) {
+		config := testConfig()
+		config.Rand = &seededReader{seed: seed}
+		c := newTestClient(t, config)
+		c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+		reply := c.sendDone("bob")
+		if reply.Header != SERVER_DONE || len(reply.Body) < aes.BlockSize {
+			t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+		}
+		return c.hello.PublicKey, reply.Body[:aes.BlockSize]
+	}
+	key, iv := handshake(1)
+	againKey, againIV := handshake(1)
+	if !bytes.Equal(key, againKey) || !bytes.Equal(iv, againIV) {
+		t.Errorf("the same source gave keys %s and %s, IVs %x and %x", key, againKey, iv, againIV)
+	}
+	otherKey, otherIV := handshake(2)
+	if bytes.Equal(key, otherKey) || bytes.Equal(iv, otherIV) {
+		t.Errorf("different sources gave key %s and IV %x twice", key, iv)
+	}
+}
+
+func TestRandTimeout(t *testing.T) {
+	random := &blockingReader{release: make(chan struct{})}
+	config := testConfig()
+	config.Rand = random
+	config.RandTimeout = 50 * time.Millisecond
+
+	c := newTestClient(t, config)
+	body, err := protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(CLIENT_HELLO, body)
+	if code, _ := errorCode(t, c.recv()); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Errorf("got error %d, want ERR_HANDSHAKE_FAILED", code)
+	}
+	// The timeout ends the connection, the client cannot queue up more
+	// generations behind the stuck one.
+	if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+		t.Errorf("reading after the timeout = %v, want io.EOF", err)
+	}
+
+	// While the first generation is stuck, the next ones time out without
+	// reading Rand alongside it.
+	if _, _, err := generateKeyPair(config); !errors.Is(err, errRandTimeout) {
+		t.Errorf("generateKeyPair() = %v, want errRandTimeout", err)
+	}
+	if n := random.reads.Load(); n != 1 {
+		t.Errorf("Rand was read %d times at once, want 1", n)
+	}
+
+	// Once Rand delivers, the stuck generation ends and frees its token.
+	close(random.release)
+	config.RandTimeout = 10 * time.Second
+	if _, _, err := generateKeyPair(config); err != nil {
+		t.Errorf("generateKeyPair() = %v after Rand recovered", err)
+	}
+}
+
+// flakyReader fails the next failures reads, and then reads from
+// crypto/rand.
+type flakyReader struct {
+	failures atomic.Int32
+	failed   atomic.Int32
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.failures.Add(-1) >= 0 {
+		r.failed.Add(1)
+		return 0, errors.New("transient failure")
+	}
+	return rand.Read(p)
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	tests := []struct {
+		name string
+		// helloFailures and doneFailures are the reads failing as the key
+		// pair is generated and as SERVER_FINISHED is encrypted.
+		helloFailures, doneFailures int32
+		ok                          bool
+	}{
+		{"no failures", 0, 0, true},
+		{"key generation", 2, 0, true},
+		{"server finished", 0, 2, true},
+		{"server finished, out of retries", 0, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			random := &flakyReader{}
+			config := testConfig()
+			config.Rand = random
+			config.HandshakeRetries = 2
+			c := newTestClient(t, config)
+
+			random.failures.Store(tt.helloFailures)
+			c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}})
+			random.failures.Store(tt.doneFailures)
+			reply := c.sendDone("bob")
+			if n := random.failed.Load(); n != tt.helloFailures+tt.doneFailures {
+				t.Errorf("%d reads failed, want %d", n, tt.helloFailures+tt.doneFailures)
+			}
+			if !tt.ok {
+				if code, text := errorCode(t, reply); code != protocol.ERR_HANDSHAKE_FAILED {
+					t.Errorf("got error %d %q, want ERR_HANDSHAKE_FAILED", code, text)
+				}
+				if c.state.getSessionKeys() != nil {
+					t.Error("the session was established without a SERVER_DONE")
+				}
+				return
+			}
+			if reply.Header != SERVER_DONE {
+				t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+			}
+			finished, err := c.suite.Decrypt(c.key, reply.Body)
+			if err != nil || !bytes.Equal(finished, append([]byte(protocol.SERVER_FINISHED), c.record.Sum()...)) {
+				t.Errorf("SERVER_DONE carries %q, %v, want the finished message", finished, err)
+			}
+		})
+	}
+}
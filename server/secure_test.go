@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+// secureClient runs a handshake over a net.Pipe, asking for acks or not,
+// and wraps the client end in a SecureConn. It returns the server end too.
+func secureClient(t *testing.T, acks bool) (*testClient, *protocol.SecureConn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	c := startTestClient(t, testConfig(), client, server)
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}, RequestAcks: acks})
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+	return c, protocol.NewSecureConn(client, c.suite, c.key), server
+}
+
+func TestSecureConnRoundTrip(t *testing.T) {
+	data := make([]byte, 3*protocol.MAX_SECURE_CHUNK_SIZE+100)
+	rand.Read(data)
+	for _, acks := range []bool{false, true} {
+		c, conn, _ := secureClient(t, acks)
+		written := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(conn, bytes.NewReader(data))
+			if err == nil {
+				err = conn.CloseWrite()
+			}
+			written <- err
+		}()
+		// The server echoes what we write, or acknowledges it without
+		// sending anything back, until its close notify.
+		var echo bytes.Buffer
+		if _, err := io.Copy(&echo, conn); err != nil {
+			t.Errorf("acks %v: reading the session: %v", acks, err)
+		}
+		if err := <-written; err != nil {
+			t.Errorf("acks %v: writing the session: %v", acks, err)
+		}
+		want := data
+		if acks {
+			want = nil
+		}
+		if !bytes.Equal(echo.Bytes(), want) {
+			t.Errorf("acks %v: read back %d bytes, want %d", acks, echo.Len(), len(want))
+		}
+		conn.Close()
+		<-c.done
+		if c.state.closeReason != CLOSE_NORMAL {
+			t.Errorf("acks %v: close reason = %q, want %q", acks, c.state.closeReason, CLOSE_NORMAL)
+		}
+	}
+}
+
+func TestSecureConnTruncatedByPeer(t *testing.T) {
+	_, conn, server := secureClient(t, false)
+	go conn.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q, %v, want the echo", b, err)
+	}
+	// Someone on the path cuts the stream, the server had no say in it.
+	server.Close()
+	if _, err := conn.Read(b); !errors.Is(err, protocol.ErrTruncated) {
+		t.Errorf("Read() = %v after the cut, want ErrTruncated", err)
+	}
+}
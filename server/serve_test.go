@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestServeReturnsOnListenerClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, testConfig())
+	}()
+
+	// A client that comes and goes is served before the shutdown.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	listener.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve() = %v after the listener was closed, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve() did not return after the listener was closed")
+	}
+}
+
+// fakeListener hands out its conns in turn, failing the Accepts that have a
+// nil one, and is closed once they run out. It records when each Accept came.
+type fakeListener struct {
+	net.Listener
+	conns   []net.Conn
+	accepts []time.Time
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.accepts = append(l.accepts, time.Now())
+	if len(l.conns) == 0 {
+		return nil, net.ErrClosed
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	if conn == nil {
+		return nil, errors.New("accept: too many open files")
+	}
+	return conn, nil
+}
+
+func TestServeBacksOffAcceptErrors(t *testing.T) {
+	client, server := net.Pipe()
+	client.Close()
+	listener := &fakeListener{conns: []net.Conn{nil, nil, nil, nil, server, nil}}
+	config := testConfig()
+	config.MaxAcceptBackoff = 4 * MIN_ACCEPT_BACKOFF
+	output := captureStdout(t, func() {
+		if err := serve(listener, config); err != nil {
+			t.Errorf("serve() = %v, want nil", err)
+		}
+	})
+
+	// Doubling up to the cap, and starting over after a success.
+	want := []time.Duration{MIN_ACCEPT_BACKOFF, 2 * MIN_ACCEPT_BACKOFF, 4 * MIN_ACCEPT_BACKOFF, 4 * MIN_ACCEPT_BACKOFF, 0, MIN_ACCEPT_BACKOFF}
+	if len(listener.accepts) != len(want)+1 {
+		t.Fatalf("serve() accepted %d times, want %d", len(listener.accepts), len(want)+1)
+	}
+	var retries []string
+	for _, line := range strings.Split(output, "\n") {
+		if _, delay, ok := strings.Cut(line, "retrying in "); ok {
+			retries = append(retries, delay)
+		}
+	}
+	var wantRetries []string
+	for i, delay := range want {
+		if delay > 0 {
+			wantRetries = append(wantRetries, delay.String())
+		}
+		if gap := listener.accepts[i+1].Sub(listener.accepts[i]); gap < delay {
+			t.Errorf("accept %d came %v after the previous one, want at least %v", i+1, gap, delay)
+		}
+	}
+	if strings.Join(retries, " ") != strings.Join(wantRetries, " ") {
+		t.Errorf("retried after %v, want %v", retries, wantRetries)
+	}
+}
+
+// probe serves one capabilities probe with config, and returns what the
+// server printed.
+func probe(t *testing.T, config *Config) string {
+	t.Helper()
+	return captureStdout(t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error, 1)
+		go func() {
+			served <- serve(listener, config)
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := protocol.WriteRecord(conn, CLIENT_CAPS, nil); err != nil {
+			t.Fatal(err)
+		}
+		if reply, err := protocol.ReadRecord(conn); err != nil || reply.Header != SERVER_CAPS {
+			t.Errorf("got record %d, %v, want SERVER_CAPS", reply.Header, err)
+		}
+		// The server closes the connection once it answered.
+		protocol.ReadRecord(conn)
+		listener.Close()
+		<-served
+	})
+}
+
+func TestDebugDump(t *testing.T) {
+	config := testConfig()
+	if output := probe(t, config); strings.Contains(output, "[debug]") {
+		t.Errorf("hexdump printed with debugging off:\n%s", output)
+	}
+	config.Debug = true
+	output := probe(t, config)
+	for _, want := range []string{"[debug] read ", "[debug] wrote "} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output with debugging on lacks %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	// A generation that outlives RandTimeout is left behind on purpose, see
+	// generateKeyPair. Slow as they are under the race detector, waiting
+	// for each one keeps the count exact.
+	config.RandTimeout = 0
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, config)
+	}()
+	hello, err := protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clients that come and go, half of them in the middle of the
+	// handshake, after the hello started a key generation.
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			if err := protocol.WriteRecord(conn, CLIENT_HELLO, hello); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.Close()
+	}
+	listener.Close()
+	<-served
+
+	// Closed connections take a moment to be torn down.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines after 50 connections, %d before:\n%s", after, before, buf[:runtime.Stack(buf, true)])
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+// SessionKeys is the key material of an established session, along with the
+// sequence number of the messages received under it.
+//
+// It holds no separate encryption or MAC keys, nor a nonce base: each suite
+// derives the keys it needs from the transported secret (see
+// crypt.EncryptAESCBCHMAC), and every message draws a fresh random IV, so
+// there is nothing else to keep per session. Keeping the derivation inside
+// the suites also means the client, which derives the same keys through the
+// same functions, cannot get out of step with the server.
+type SessionKeys struct {
+	// secret is the symmetric key the client transported in CLIENT_DONE.
+	secret [32]byte
+	// recvSeq is the sequence number of the last CLIENT_MSG received, the
+	// first one being 1. It is what SERVER_ACK acknowledges, and what
+	// MaxMessagesPerSession limits. The server sends nothing that is
+	// numbered, so there is no send sequence.
+	recvSeq uint64
+}
+
+func NewSessionKeys(secret [32]byte) *SessionKeys {
+	return &SessionKeys{secret: secret}
+}
+
+// key returns the key to give the negotiated suite.
+func (keys *SessionKeys) key() []byte {
+	return keys.secret[:]
+}
+
+// nextRecv advances and returns the sequence number of the message just
+// received.
+func (keys *SessionKeys) nextRecv() uint64 {
+	keys.recvSeq++
+	return keys.recvSeq
+}
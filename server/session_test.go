@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/internal/testutil"
+	"safechat/protocol"
+)
+
+func TestSessionKeys(t *testing.T) {
+	var secret [32]byte
+	secret[0] = 42
+	keys := NewSessionKeys(secret)
+	if !bytes.Equal(keys.key(), secret[:]) {
+		t.Errorf("key() = %x, want %x", keys.key(), secret)
+	}
+	for want := uint64(1); want <= 3; want++ {
+		if got := keys.nextRecv(); got != want {
+			t.Errorf("nextRecv() = %d, want %d", got, want)
+		}
+	}
+}
+
+// sendMessage sends plaintext as a CLIENT_MSG under the session key, and
+// returns the reply.
+func (c *testClient) sendMessage(plaintext string) protocol.Message {
+	c.t.Helper()
+	ciphertext, err := c.suite.Encrypt(c.key, []byte(plaintext))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(CLIENT_MSG, ciphertext)
+	return c.recv()
+}
+
+func ackSeq(t *testing.T, msg protocol.Message) uint64 {
+	t.Helper()
+	if msg.Header != SERVER_ACK || len(msg.Body) != 8 {
+		t.Fatalf("got record %d %q, want SERVER_ACK", msg.Header, msg.Body)
+	}
+	return binary.BigEndian.Uint64(msg.Body)
+}
+
+func TestSessionSequence(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(suite)}, RequestAcks: true})
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+
+	for want := uint64(1); want <= 2; want++ {
+		if got := ackSeq(t, c.sendMessage("hello")); got != want {
+			t.Errorf("message acknowledged as #%d, want #%d", got, want)
+		}
+	}
+	// A message that does not decrypt under the session key still takes
+	// its number, as the client counted it as sent.
+	c.send(CLIENT_MSG, []byte("not a ciphertext"))
+	if code, _ := errorCode(t, c.recv()); code != protocol.ERR_DECRYPT_FAILED {
+		t.Errorf("got error %d, want ERR_DECRYPT_FAILED", code)
+	}
+	if got := ackSeq(t, c.sendMessage("hello")); got != 4 {
+		t.Errorf("message acknowledged as #%d, want #4", got)
+	}
+	if got := c.state.getSessionKeys().recvSeq; got != 4 {
+		t.Errorf("recvSeq = %d, want 4", got)
+	}
+}
+
+func TestSessionMessageLimit(t *testing.T) {
+	config := testConfig()
+	config.MaxMessagesPerSession = 2
+	c := newTestClient(t, config)
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}, RequestAcks: true})
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+	ackSeq(t, c.sendMessage("one"))
+	ackSeq(t, c.sendMessage("two"))
+	if msg := c.recv(); msg.Header != SERVER_CLOSE {
+		t.Fatalf("got record %d %q, want SERVER_CLOSE", msg.Header, msg.Body)
+	}
+	if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+		t.Errorf("reading after SERVER_CLOSE = %v, want io.EOF", err)
+	}
+}
+
+func TestConnStateExportKeyingMaterial(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+	// processClient is waiting for CLIENT_DONE.
+	if out, err := c.state.ExportKeyingMaterial("test label", 32); err == nil {
+		t.Errorf("ExportKeyingMaterial() before CLIENT_DONE = %x, want an error", out)
+	}
+	if reply := c.sendDone("bob"); reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+
+	got, err := c.state.ExportKeyingMaterial("test label", 32)
+	if err != nil {
+		t.Fatalf("ExportKeyingMaterial() = %v", err)
+	}
+	want, err := crypt.ExportKeyingMaterial(c.key, "test label", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("server exported %x, client %x", got, want)
+	}
+	if _, err := c.state.ExportKeyingMaterial("test label", -1); err == nil {
+		t.Error("ExportKeyingMaterial(-1) succeeded")
+	}
+}
+
+func TestMaxPlaintextSize(t *testing.T) {
+	config := testConfig()
+	config.MaxPlaintextSize = 16
+	c := newTestClient(t, config)
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+
+	// The ciphertext of 17 bytes is well within the record limit, only the
+	// plaintext is too large.
+	if code, text := errorCode(t, c.sendMessage(strings.Repeat("x", 17))); code != protocol.ERR_MESSAGE_TOO_LARGE {
+		t.Errorf("got error %d %q, want ERR_MESSAGE_TOO_LARGE", code, text)
+	}
+	if reply := c.sendMessage(strings.Repeat("x", 16)); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q for a message at the limit, want SERVER_MSG", reply.Header, reply.Body)
+	}
+}
+
+func TestPipelinedMessages(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	plaintexts := []string{"first", "second"}
+	var both bytes.Buffer
+	for _, plaintext := range plaintexts {
+		ciphertext, err := c.suite.Encrypt(c.key, []byte(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		protocol.WriteRecord(&both, CLIENT_MSG, ciphertext)
+	}
+	// Both records go out in a single write, which only returns once the
+	// server read them and so has to run while we read the replies.
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.conn.Write(both.Bytes())
+		written <- err
+	}()
+	for _, plaintext := range plaintexts {
+		reply := c.recv()
+		if reply.Header != SERVER_MSG {
+			t.Fatalf("got record %d %q, want the SERVER_MSG echoing %q", reply.Header, reply.Body, plaintext)
+		}
+		if got, err := c.suite.Decrypt(c.key, reply.Body); err != nil || string(got) != plaintext {
+			t.Errorf("echo = %q, %v, want %q", got, err, plaintext)
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingReader counts the calls to Read of the reader it wraps, each of
+// which is a syscall on a connection.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(b)
+}
+
+// BenchmarkPipelinedRecords reads a burst of pipelined CLIENT_MSG records
+// from a loopback connection the way processClient does, through a
+// READ_BUFFER_SIZE buffer, and straight from the connection as before that
+// buffer. reads/record is the syscalls each record costs.
+func BenchmarkPipelinedRecords(b *testing.B) {
+	const records = 1000
+	var stream bytes.Buffer
+	for i := 0; i < records; i++ {
+		protocol.WriteRecord(&stream, CLIENT_MSG, make([]byte, 80))
+	}
+	data := stream.Bytes()
+	for _, buffered := range []bool{true, false} {
+		b.Run(fmt.Sprintf("buffered=%v", buffered), func(b *testing.B) {
+			client, server, err := testutil.NewLoopback()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			defer server.Close()
+			written := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(data); err != nil {
+						written <- err
+						return
+					}
+				}
+				written <- nil
+			}()
+
+			conn := &countingReader{Reader: server}
+			var r io.Reader = conn
+			if buffered {
+				r = bufio.NewReaderSize(conn, READ_BUFFER_SIZE)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N*records; i++ {
+				if _, err := protocol.ReadRecord(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if err := <-written; err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(conn.reads)/float64(b.N*records), "reads/record")
+		})
+	}
+}
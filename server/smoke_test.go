@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClientSmoke builds the client and has it run a session against a
+// real server: handshake, one message and its echo, and a close.
+func TestClientSmoke(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the client")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool to build the client with")
+	}
+	client := filepath.Join(t.TempDir(), "client")
+	if out, err := exec.Command(goTool, "build", "-o", client, "safechat/client").CombinedOutput(); err != nil {
+		t.Fatalf("building the client: %v\n%s", err, out)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, testConfig())
+	}()
+	defer func() {
+		listener.Close()
+		<-served
+	}()
+
+	cmd := exec.Command(client, "-close-timeout", "10s")
+	// The address, the username, a message, and CLIENT_CLOSE.
+	cmd.Stdin = strings.NewReader(listener.Addr().String() + "\nbob\nhello\n7:\n")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("client failed: %v\n%s", err, out.String())
+		}
+	case <-time.After(60 * time.Second):
+		cmd.Process.Kill()
+		<-exited
+		t.Fatalf("client did not exit\n%s", out.String())
+	}
+	for _, want := range []string{
+		"[server done] handshake complete",
+		"[message] server encrypted message as: ",
+		"[server close] session closed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("client output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
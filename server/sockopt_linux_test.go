@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+	"safechat/internal/testutil"
+	"safechat/protocol"
+)
+
+// sockopt reads an integer socket option of conn.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func loopback(t *testing.T) net.Conn {
+	t.Helper()
+	client, server, err := testutil.NewLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	conn := loopback(t)
+	if err := setKeepAlive(conn, 42*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if on := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); on == 0 {
+		t.Error("SO_KEEPALIVE is off")
+	}
+	if idle := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 42 {
+		t.Errorf("TCP_KEEPIDLE = %ds, want 42s", idle)
+	}
+
+	if err := setKeepAlive(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if on := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); on != 0 {
+		t.Error("SO_KEEPALIVE is still on with a zero period")
+	}
+}
+
+func TestSetKeepAliveIgnoresOtherTransports(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := setKeepAlive(server, time.Second); err != nil {
+		t.Errorf("setKeepAlive() on a net.Pipe = %v, want nil", err)
+	}
+}
+
+func TestSetNoDelay(t *testing.T) {
+	conn := loopback(t)
+	// Go turns TCP_NODELAY on for every TCP connection, switching it off
+	// first shows setNoDelay is what turns it back on.
+	for _, noDelay := range []bool{false, true} {
+		if err := setNoDelay(conn, noDelay); err != nil {
+			t.Fatal(err)
+		}
+		if on := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; on != noDelay {
+			t.Errorf("setNoDelay(%v): TCP_NODELAY is %v", noDelay, on)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := setNoDelay(server, true); err != nil {
+		t.Errorf("setNoDelay() on a net.Pipe = %v, want nil", err)
+	}
+}
+
+func TestNegotiatedKeepAlive(t *testing.T) {
+	client, server, err := testutil.NewLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.KeepAlivePeriod = time.Minute
+	// The accept loop applies the configured period before the session
+	// starts, the hello replaces it.
+	if err := setKeepAlive(server, config.KeepAlivePeriod); err != nil {
+		t.Fatal(err)
+	}
+	c := startTestClient(t, config, client, server)
+	c.sendHello(protocol.ClientHello{
+		Suites:    []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)},
+		KeepAlive: 10 * time.Second,
+	})
+	if c.hello.KeepAlive != 10*time.Second {
+		t.Errorf("server agreed to a keepalive period of %v, want 10s", c.hello.KeepAlive)
+	}
+	if idle := sockopt(t, server, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 10 {
+		t.Errorf("TCP_KEEPIDLE = %ds, want 10s", idle)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+var serverHeaders = []byte{SERVER_HELLO, SERVER_DONE, SERVER_MSG, SERVER_CLOSE, SERVER_ACK, SERVER_CAPS, SERVER_LIST}
+
+func TestServerHeadersRejected(t *testing.T) {
+	suite := crypt.SUITE_AES_256_CBC_HMAC_SHA256
+	spoof := func(c *testClient, phase string) {
+		for _, header := range serverHeaders {
+			c.send(header, []byte("spoofed"))
+			if code, text := errorCode(t, c.recv()); code != protocol.ERR_UNEXPECTED_MESSAGE {
+				t.Errorf("header %d %s: got error %d %q, want ERR_UNEXPECTED_MESSAGE", header, phase, code, text)
+			}
+		}
+	}
+
+	// None of them disturbs the handshake that follows, as long as they
+	// stay within the handshake's message budget.
+	config := testConfig()
+	config.MaxHandshakeMessages = len(serverHeaders) + 2
+	c := newTestClient(t, config)
+	spoof(c, "before the handshake")
+	c.handshake(suite, "bob")
+
+	// Nor the session.
+	c = newTestClient(t, testConfig())
+	c.handshake(suite, "bob")
+	spoof(c, "during the session")
+	if reply := c.sendMessage("hi"); reply.Header != SERVER_MSG {
+		t.Errorf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+}
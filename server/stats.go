@@ -0,0 +1,41 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Counters published through expvar, under /debug/vars when a debug
+// listener is configured.
+var (
+	statConnections = expvar.NewInt("safechat_connections")
+	statHandshakes  = expvar.NewInt("safechat_handshakes")
+	statMessages    = expvar.NewInt("safechat_messages")
+	// statCloses counts the connections that ended, by close reason.
+	statCloses = expvar.NewMap("safechat_closes")
+)
+
+// serveDebug serves the expvar endpoint on addr in the background. The debug
+// listener exposes internals, it is meant to be bound to a private address.
+func serveDebug(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Serving debug variables on " + listener.Addr().String() + "/debug/vars")
+	mux := debugMux()
+	go func() {
+		err := http.Serve(listener, mux)
+		fmt.Println("Debug listener stopped: ", err.Error())
+	}()
+	return nil
+}
+
+// debugMux routes what the debug listener serves.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+)
+
+// debugVars fetches the counters from the expvar endpoint.
+func debugVars(t *testing.T) (counters map[string]int64, closes map[string]int64) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/debug/vars", nil)
+	debugMux().ServeHTTP(recorder, request)
+	var vars struct {
+		Connections int64            `json:"safechat_connections"`
+		Handshakes  int64            `json:"safechat_handshakes"`
+		Messages    int64            `json:"safechat_messages"`
+		Closes      map[string]int64 `json:"safechat_closes"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("decoding /debug/vars: %v", err)
+	}
+	counters = map[string]int64{
+		"connections": vars.Connections,
+		"handshakes":  vars.Handshakes,
+		"messages":    vars.Messages,
+	}
+	return counters, vars.Closes
+}
+
+func TestDebugVarsAfterSession(t *testing.T) {
+	before, closesBefore := debugVars(t)
+
+	// A session with two messages, closed by the client.
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	c.sendMessage("one")
+	c.sendMessage("two")
+	c.sendClose()
+	<-c.done
+
+	// Connections are counted as the accept loop takes them.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, testConfig())
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// The listener is only closed once the accept loop took the
+	// connection, serve then returns after serving it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		counters, _ := debugVars(t)
+		if counters["connections"] > before["connections"] || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	listener.Close()
+	<-served
+
+	after, closesAfter := debugVars(t)
+	want := map[string]int64{"connections": 1, "handshakes": 1, "messages": 2}
+	for name, delta := range want {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("safechat_%s went up by %d, want %d", name, got, delta)
+		}
+	}
+	if got := closesAfter[CLOSE_NORMAL] - closesBefore[CLOSE_NORMAL]; got != 1 {
+		t.Errorf("safechat_closes[%q] went up by %d, want 1", CLOSE_NORMAL, got)
+	}
+	if got := closesAfter[CLOSE_PEER_EOF] - closesBefore[CLOSE_PEER_EOF]; got != 1 {
+		t.Errorf("safechat_closes[%q] went up by %d, want 1", CLOSE_PEER_EOF, got)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestStrictHandshake(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		config := testConfig()
+		config.StrictHandshake = strict
+		c := newTestClient(t, config)
+		c.send(CLIENT_MSG, []byte("not encrypted"))
+		if code, text := errorCode(t, c.recv()); code != protocol.ERR_UNEXPECTED_MESSAGE {
+			t.Errorf("strict %v: got error %d %q, want ERR_UNEXPECTED_MESSAGE", strict, code, text)
+		}
+		if !strict {
+			// The client may still go on with its handshake.
+			c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+			continue
+		}
+		if _, err := protocol.ReadRecord(c.conn); err != io.EOF {
+			t.Errorf("strict %v: reading after the error: %v, want EOF", strict, err)
+		}
+		<-c.done
+		if c.state.closeReason != CLOSE_PROTOCOL_ERROR {
+			t.Errorf("strict %v: close reason = %q, want %q", strict, c.state.closeReason, CLOSE_PROTOCOL_ERROR)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestTranscriptMatches(t *testing.T) {
+	challenge := make([]byte, protocol.CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		hello protocol.ClientHello
+	}{
+		{"CFB", protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CFB)}}},
+		{"CBC-HMAC", protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}}},
+		{"extensions", protocol.ClientHello{
+			Suites:        []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)},
+			RequestAcks:   true,
+			CorrelationID: []byte("abc"),
+			Challenge:     challenge,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, testConfig())
+			c.sendHello(tt.hello)
+			reply := c.sendDone("bob")
+			if reply.Header != SERVER_DONE {
+				t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+			}
+
+			finished, err := c.suite.Decrypt(c.key, reply.Body)
+			if err != nil {
+				t.Fatalf("decrypting SERVER_DONE: %v", err)
+			}
+			want := append([]byte(protocol.SERVER_FINISHED), c.record.Sum()...)
+			if !bytes.Equal(finished, want) {
+				t.Errorf("SERVER_DONE carries %x, want %x", finished, want)
+			}
+			// processClient is waiting for the next record, done with the
+			// transcript.
+			if !bytes.Equal(c.state.transcript.Bytes(), c.record.Bytes()) {
+				t.Errorf("server transcript\n%x\nwant the client's\n%x", c.state.transcript.Bytes(), c.record.Bytes())
+			}
+		})
+	}
+}
+
+// A CLIENT_DONE the server rejects is left out of its transcript, so the one
+// that follows it hashes the same as on a client that never sent it.
+func TestTranscriptSkipsRejectedDone(t *testing.T) {
+	config := testConfig()
+	config.Authenticator = passwords{"bob": "hunter2"}
+	c := newTestClient(t, config)
+	c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+	accepted := c.record.Clone()
+
+	if code, _ := errorCode(t, c.sendDone("bob:wrong")); code != protocol.ERR_HANDSHAKE_FAILED {
+		t.Fatalf("got error %d, want ERR_HANDSHAKE_FAILED", code)
+	}
+	c.record = accepted
+	reply := c.sendDone("bob:hunter2")
+	if reply.Header != SERVER_DONE {
+		t.Fatalf("got record %d %q, want SERVER_DONE", reply.Header, reply.Body)
+	}
+	finished, err := c.suite.Decrypt(c.key, reply.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(finished[len(protocol.SERVER_FINISHED):], c.record.Sum()) {
+		t.Errorf("SERVER_DONE hash does not match the client transcript")
+	}
+}
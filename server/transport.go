@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// The server runs the protocol over any io.ReadWriteCloser: a net.Conn, an
+// in-memory pipe, or a stream layered over another transport such as a
+// websocket. What it needs beyond reading, writing and closing is optional,
+// and only used when the transport provides it.
+
+// readDeadliner is implemented by transports that can bound how long a read
+// blocks. Without it the handshake timeout is not enforced.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// remoteAddresser is implemented by transports that know their peer's
+// address.
+type remoteAddresser interface {
+	RemoteAddr() net.Addr
+}
+
+func setReadDeadline(transport io.ReadWriteCloser, t time.Time) error {
+	if d, ok := transport.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// remoteAddr returns the peer address of transport, nil when it has none.
+func remoteAddr(transport io.ReadWriteCloser) net.Addr {
+	if a, ok := transport.(remoteAddresser); ok {
+		return a.RemoteAddr()
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	crypt "safechat/encryption"
+)
+
+func TestSessionOverReadWriteCloser(t *testing.T) {
+	// The in-memory transport is nothing but a ReadWriteCloser.
+	var transport io.ReadWriteCloser = pipeTransport{}
+	if _, ok := transport.(readDeadliner); ok {
+		t.Fatal("pipeTransport has read deadlines")
+	}
+	if _, ok := transport.(remoteAddresser); ok {
+		t.Fatal("pipeTransport has a remote address")
+	}
+	if err := setReadDeadline(transport, time.Now()); err != nil {
+		t.Errorf("setReadDeadline() = %v without deadlines, want nil", err)
+	}
+
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	reply := c.sendMessage("hello")
+	if reply.Header != SERVER_MSG {
+		t.Fatalf("got record %d %q, want SERVER_MSG", reply.Header, reply.Body)
+	}
+	if plaintext, err := c.suite.Decrypt(c.key, reply.Body); err != nil || len(plaintext) == 0 {
+		t.Errorf("SERVER_MSG decrypts to %q, %v", plaintext, err)
+	}
+	c.sendClose()
+	<-c.done
+	info := c.state.ConnectionState()
+	if !info.HandshakeComplete || info.Username != "bob" {
+		t.Errorf("ConnectionState() = %+v, want a complete handshake for bob", info)
+	}
+	if info.RemoteAddr != nil {
+		t.Errorf("RemoteAddr = %v over a transport without addresses, want nil", info.RemoteAddr)
+	}
+}
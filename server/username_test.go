@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	crypt "safechat/encryption"
+	"safechat/protocol"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"bob", true},
+		{"Alice_01", true},
+		{"j.doe-2", true},
+		{strings.Repeat("a", MAX_USERNAME_LEN), true},
+		{"", false},
+		{strings.Repeat("a", MAX_USERNAME_LEN+1), false},
+		{"bob smith", false},
+		{"bob\n", false},
+		{"bob\x00", false},
+		{"bob\x1b[2J", false},
+		{"bob\x7f", false},
+		{"b:ob", false},
+		{"bøb", false},
+		{"ボブ", false},
+	}
+	for _, tt := range tests {
+		err := validateUsername(tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("validateUsername(%q) = %v, want nil", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("validateUsername(%q) = nil, want an error", tt.name)
+		}
+	}
+}
+
+func TestUsernameAssociatedWithSession(t *testing.T) {
+	c := newTestClient(t, testConfig())
+	c.handshake(crypt.SUITE_AES_256_CBC_HMAC_SHA256, "bob")
+	if got := c.state.getUsername(); got != "bob" {
+		t.Errorf("session username = %q, want bob", got)
+	}
+	// The rest of the state is only settled once the session is over.
+	c.conn.Close()
+	<-c.done
+	if got := c.state.ConnectionState().Username; got != "bob" {
+		t.Errorf("ConnectionState().Username = %q, want bob", got)
+	}
+}
+
+func TestUsernameRejected(t *testing.T) {
+	for _, name := range []string{strings.Repeat("a", MAX_USERNAME_LEN+1), "bob\x07", "bob\r\nPASS x"} {
+		c := newTestClient(t, testConfig())
+		c.sendHello(protocol.ClientHello{Suites: []byte{byte(crypt.SUITE_AES_256_CBC_HMAC_SHA256)}})
+		if code, text := errorCode(t, c.sendDone(name)); code != protocol.ERR_HANDSHAKE_FAILED {
+			t.Errorf("username %q: got error %d %q, want ERR_HANDSHAKE_FAILED", name, code, text)
+		}
+		if c.state.username != "" {
+			t.Errorf("username %q: session took username %q", name, c.state.username)
+		}
+	}
+}
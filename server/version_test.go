@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"safechat/protocol"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	const min = protocol.VERSION
+	tests := []struct {
+		name    string
+		offered byte
+		want    byte
+		wantErr bool
+	}{
+		{"above the minimum", protocol.VERSION + 1, protocol.VERSION, false},
+		{"at the minimum", min, min, false},
+		{"below the minimum", min - 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateVersion(tt.offered, min)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiateVersion(%d, %d) error = %v, want error %v", tt.offered, min, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("negotiateVersion(%d, %d) = %d, want %d", tt.offered, min, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMinVersion(t *testing.T) {
+	t.Setenv("SAFECHAT_MIN_VERSION", "1")
+	if _, err := LoadConfig(""); err != nil {
+		t.Errorf("LoadConfig() with the current version = %v", err)
+	}
+	t.Setenv("SAFECHAT_MIN_VERSION", "2")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() accepted a minimum version newer than the protocol")
+	}
+}